@@ -43,3 +43,207 @@ CREATE TABLE haveread (
 ALTER TABLE `message` ADD INDEX (`channel_id`);
 ALTER TABLE `channel` ADD COLUMN message_cnt INT UNSIGNED NOT NULL DEFAULT 0;
 CREATE TRIGGER tr1 BEFORE INSERT ON `message` FOR EACH ROW UPDATE `channel` SET `message_cnt`=`message_cnt`+1 WHERE id = NEW.channel_id;
+
+ALTER TABLE `message` ADD COLUMN edited_at DATETIME NULL;
+CREATE TABLE message_revision (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  message_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL,
+  content TEXT,
+  created_at DATETIME NOT NULL,
+  INDEX (message_id),
+  INDEX (channel_id, id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `message` ADD COLUMN deleted_at DATETIME NULL;
+ALTER TABLE `channel` ADD COLUMN deleted_cnt INT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE `channel` ADD COLUMN owner_id BIGINT NOT NULL DEFAULT 0;
+CREATE TRIGGER tr2 BEFORE UPDATE ON `message` FOR EACH ROW UPDATE `channel` SET `message_cnt`=`message_cnt`-1, `deleted_cnt`=`deleted_cnt`+1 WHERE id = NEW.channel_id AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL;
+
+ALTER TABLE `message` ADD COLUMN parent_id BIGINT NULL, ADD COLUMN reply_cnt INT UNSIGNED NOT NULL DEFAULT 0, ADD COLUMN last_reply_at DATETIME NULL, ADD INDEX (parent_id);
+DROP TRIGGER tr1;
+CREATE TRIGGER tr1 BEFORE INSERT ON `message` FOR EACH ROW UPDATE `channel` SET `message_cnt`=`message_cnt`+1 WHERE id = NEW.channel_id AND NEW.parent_id IS NULL;
+DROP TRIGGER tr2;
+CREATE TRIGGER tr2 BEFORE UPDATE ON `message` FOR EACH ROW UPDATE `channel` SET `message_cnt`=`message_cnt`-1, `deleted_cnt`=`deleted_cnt`+1 WHERE id = NEW.channel_id AND NEW.parent_id IS NULL AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL;
+CREATE TABLE thread_haveread (
+  user_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL,
+  read_cnt INT UNSIGNED NOT NULL DEFAULT 0,
+  updated_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(user_id, message_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE reaction (
+  message_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  emoji VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(message_id, user_id, emoji)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE `channel` ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'public', ADD COLUMN dm_key VARCHAR(191) NULL UNIQUE;
+CREATE TABLE channel_member (
+  channel_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(channel_id, user_id),
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE `channel_member` ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member';
+INSERT INTO channel_member (channel_id, user_id, role, created_at) SELECT id, owner_id, 'owner', NOW() FROM channel WHERE owner_id > 0 ON DUPLICATE KEY UPDATE role = 'owner';
+ALTER TABLE `channel` DROP COLUMN owner_id;
+CREATE TABLE mention (
+  user_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL,
+  parent_id BIGINT NULL,
+  read_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(user_id, message_id),
+  INDEX (user_id, channel_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE `message` ADD FULLTEXT INDEX message_content_ft (content) WITH PARSER ngram;
+ALTER TABLE `message` ADD INDEX (channel_id, created_at);
+ALTER TABLE `user` MODIFY password VARCHAR(255);
+CREATE TABLE session (
+  id CHAR(64) NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE api_token (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  scopes VARCHAR(64) NOT NULL,
+  last_used_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE `user` ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE webhook (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  channel_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  creator_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  rate_limit INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (channel_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE event_subscription (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  owner_id BIGINT NOT NULL,
+  target_url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  secret CHAR(64) NOT NULL,
+  last_status INT NULL,
+  last_error TEXT NULL,
+  last_delivery_at DATETIME NULL,
+  failure_count INT NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  INDEX (owner_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE event_outbox (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  subscription_id BIGINT NOT NULL,
+  event_type VARCHAR(64) NOT NULL,
+  payload MEDIUMTEXT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME NOT NULL,
+  last_status INT NULL,
+  last_error TEXT NULL,
+  delivered_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (status, next_attempt_at),
+  INDEX (subscription_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE slash_command (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  channel_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  creator_id BIGINT NOT NULL,
+  name VARCHAR(32) NOT NULL,
+  url VARCHAR(2048) NOT NULL,
+  secret CHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  UNIQUE KEY (channel_id, name)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE scheduled_job (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  kind VARCHAR(16) NOT NULL,
+  user_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL DEFAULT 0,
+  parent_id BIGINT NULL,
+  message_id BIGINT NULL,
+  content TEXT NOT NULL,
+  run_at DATETIME NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  locked_until DATETIME NULL,
+  last_error TEXT NULL,
+  done_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (status, run_at),
+  INDEX (user_id, run_at)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE user_identity (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  issuer VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  user_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  UNIQUE KEY (issuer, subject),
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE user_totp (
+  user_id BIGINT NOT NULL PRIMARY KEY,
+  secret VARCHAR(64) NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT FALSE,
+  last_step BIGINT NOT NULL DEFAULT 0,
+  failed_attempts INT NOT NULL DEFAULT 0,
+  locked_until DATETIME NULL,
+  created_at DATETIME NOT NULL
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE recovery_code (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  code_hash CHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (user_id, code_hash)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE login_attempt (
+  attempt_key VARCHAR(255) NOT NULL PRIMARY KEY,
+  failures INT NOT NULL,
+  first_failure_at DATETIME NOT NULL,
+  locked_until DATETIME NULL
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE `user` ADD COLUMN email VARCHAR(255) NULL;
+CREATE TABLE password_reset (
+  token_hash CHAR(64) NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  expires_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE `user` ADD COLUMN session_gen BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE `event_outbox` ADD INDEX (status, created_at);
+CREATE TABLE email_change (
+  token_hash CHAR(64) NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  expires_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL,
+  INDEX (user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+CREATE TABLE webhook_rate (
+  webhook_id BIGINT NOT NULL PRIMARY KEY,
+  tokens DOUBLE NOT NULL,
+  last DATETIME(6) NOT NULL
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	passwordResetTTL  = time.Hour
+	passwordMinLength = 8
+	emailChangeTTL    = 24 * time.Hour
+
+	deletedDisplayName = "退会したユーザ"
+	// deleted users are renamed to this prefix and their id
+	deletedNamePrefix = "deleted-"
+)
+
+var errPasswordTooShort = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("password must be at least %d characters", passwordMinLength))
+
+// tokenHash is what is stored of the tokens mailed in links.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// setPassword stores a new password for userID and logs it out everywhere,
+// since whoever knew the old password may still be logged in.
+func setPassword(userID int64, password string) error {
+	digest, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE user SET salt = '', password = ? WHERE id = ?", digest, userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM password_reset WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return revokeUserSessions(userID)
+}
+
+// resetBaseURL is where the links in reset mails point to. Resets are off
+// without it: taken from the Host header, the links could be made to point
+// to anybody's site.
+func resetBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("ISUBATA_BASE_URL"), "/")
+}
+
+// postPassword changes the password of the user. Wrong current passwords
+// count against the account like failed logins.
+func postPassword(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	// users created by single sign-on set their first password with a reset
+	if self.Password == "" {
+		return ErrBadReqeust
+	}
+	nameKey := "login:name:" + self.Name
+	if err := checkLockout(c, "password_change_locked", nameKey); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+
+	pw := c.FormValue("new_password")
+	if len(pw) < passwordMinLength {
+		return errPasswordTooShort
+	}
+	ok, _, err := verifyPassword(self, c.FormValue("current_password"))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !ok {
+		recordFailure(map[string]*LockoutPolicy{nameKey: loginNamePolicy})
+		audit(c, "password_change_failed", map[string]interface{}{"user_id": self.ID})
+		return echo.ErrForbidden
+	}
+
+	if err := setPassword(self.ID, pw); err != nil {
+		log.Println(err)
+		return err
+	}
+	audit(c, "password_changed", map[string]interface{}{"user_id": self.ID})
+	// the other sessions are gone, this one gets a fresh token
+	if err := sessSetUserID(c, self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/profile/"+self.Name)
+}
+
+func renderPasswordReset(c echo.Context, data map[string]interface{}) error {
+	data["ChannelID"] = 0
+	data["Channels"] = []ChannelInfo{}
+	data["User"] = nil
+	return c.Render(http.StatusOK, "password_reset", data)
+}
+
+func getPasswordReset(c echo.Context) error {
+	if !passwordLogin || resetBaseURL() == "" {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return renderPasswordReset(c, map[string]interface{}{})
+}
+
+// postPasswordReset mails a reset link to the address of the account. The
+// answer is the same whether or not the account exists or has an address.
+func postPasswordReset(c echo.Context) error {
+	if !passwordLogin || resetBaseURL() == "" {
+		return echo.ErrForbidden
+	}
+	ipKey := "reset:ip:" + c.RealIP()
+	if err := checkLockout(c, "password_reset_locked", ipKey); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		return ErrBadReqeust
+	}
+	// every request counts, each one may send a mail
+	recordFailure(map[string]*LockoutPolicy{ipKey: resetIPPolicy})
+	audit(c, "password_reset_requested", map[string]interface{}{"name": name})
+
+	var user User
+	err := db.Get(&user, "SELECT * FROM user WHERE name = ?", name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		return err
+	}
+	if err == nil && !user.IsBot && user.Email != nil {
+		if err := sendPasswordReset(&user); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return renderPasswordReset(c, map[string]interface{}{"Sent": true})
+}
+
+func sendPasswordReset(user *User) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO password_reset (token_hash, user_id, expires_at, created_at) VALUES (?, ?, ?, NOW())",
+		tokenHash(token), user.ID, time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("%s さん\n\n以下のリンクからパスワードを再設定してください。リンクは%d分間有効です。\n\n%s/password/reset/%s\n\n"+
+		"心当たりがない場合はこのメールを無視してください。\n",
+		user.DisplayName, int(passwordResetTTL.Minutes()), resetBaseURL(), token)
+	return mailer.Send(*user.Email, "パスワードの再設定", body)
+}
+
+// queryPasswordReset returns the user a valid reset token is for, 0 if the
+// token is unknown or expired.
+func queryPasswordReset(token string) (int64, error) {
+	var userID int64
+	err := db.Get(&userID, "SELECT user_id FROM password_reset WHERE token_hash = ? AND expires_at > NOW()", tokenHash(token))
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+func getPasswordResetToken(c echo.Context) error {
+	userID, err := queryPasswordReset(c.Param("token"))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if userID == 0 {
+		return renderPasswordReset(c, map[string]interface{}{"Error": "リンクが無効か、期限切れです"})
+	}
+	return renderPasswordReset(c, map[string]interface{}{"Token": c.Param("token")})
+}
+
+func postPasswordResetToken(c echo.Context) error {
+	token := c.Param("token")
+	pw := c.FormValue("password")
+	if len(pw) < passwordMinLength {
+		return errPasswordTooShort
+	}
+	userID, err := queryPasswordReset(token)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	// deleting the token claims it, so that it works only once
+	res, err := db.Exec("DELETE FROM password_reset WHERE token_hash = ?", tokenHash(token))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); userID == 0 || n == 0 {
+		return renderPasswordReset(c, map[string]interface{}{"Error": "リンクが無効か、期限切れです"})
+	}
+	user, err := getUser(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return echo.ErrNotFound
+	}
+
+	if err := setPassword(user.ID, pw); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := attemptStore.Reset("login:name:" + user.Name); err != nil {
+		log.Println(err)
+	}
+	audit(c, "password_reset", map[string]interface{}{"user_id": user.ID})
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// postDeleteAccount deletes the account of the user after checking the
+// password, or the user name for accounts without a password.
+func postDeleteAccount(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	if self.Password != "" {
+		nameKey := "login:name:" + self.Name
+		if err := checkLockout(c, "account_delete_locked", nameKey); err != nil {
+			if _, ok := err.(*echo.HTTPError); !ok {
+				log.Println(err)
+			}
+			return err
+		}
+		ok, _, err := verifyPassword(self, c.FormValue("password"))
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		if !ok {
+			recordFailure(map[string]*LockoutPolicy{nameKey: loginNamePolicy})
+			audit(c, "account_delete_failed", map[string]interface{}{"user_id": self.ID})
+			return echo.ErrForbidden
+		}
+	} else if c.FormValue("confirm_name") != self.Name {
+		return ErrBadReqeust
+	}
+
+	if err := deleteAccount(self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	audit(c, "account_deleted", map[string]interface{}{"user_id": self.ID, "name": self.Name})
+	sessClear(c)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// deleteAccount removes everything tied to userID. The user row is kept as
+// an anonymous placeholder so that the messages stay readable without
+// showing who wrote them, and the name becomes free for a new account.
+// Channels the user owns are handed over to another member.
+func deleteAccount(userID int64) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chanIDs := make([]int64, 0)
+	if err := tx.Select(&chanIDs, "SELECT channel_id FROM channel_member WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE user SET name = CONCAT(?, id), salt = '', password = '', display_name = ?,"+
+		" avatar_icon = 'default.png', email = NULL, session_gen = session_gen + 1 WHERE id = ?",
+		deletedNamePrefix, deletedDisplayName, userID); err != nil {
+		return err
+	}
+	// like an owner can't leave, a channel must not lose its owner: the
+	// oldest moderator, or else the oldest member, takes over
+	owned := make([]int64, 0)
+	if err := tx.Select(&owned, "SELECT channel_id FROM channel_member WHERE user_id = ? AND role = ?", userID, roleOwner); err != nil {
+		return err
+	}
+	successors := make(map[int64]int64, len(owned))
+	for _, chanID := range owned {
+		var next int64
+		err := tx.Get(&next, "SELECT m.user_id FROM channel_member m JOIN user u ON u.id = m.user_id"+
+			" WHERE m.channel_id = ? AND m.user_id <> ? AND NOT u.is_bot"+
+			" ORDER BY m.role = ? DESC, m.created_at LIMIT 1 FOR UPDATE", chanID, userID, roleModerator)
+		if err == sql.ErrNoRows {
+			// nobody left to manage it
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE channel_member SET role = ? WHERE channel_id = ? AND user_id = ?", roleOwner, chanID, next); err != nil {
+			return err
+		}
+		successors[chanID] = next
+	}
+
+	for _, table := range []string{
+		"haveread", "thread_haveread", "mention", "reaction", "channel_member", "session", "api_token",
+		"user_identity", "user_totp", "recovery_code", "password_reset", "email_change", "scheduled_job",
+	} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+	}
+	// the bots of the user's webhooks and commands would keep posting
+	for _, table := range []string{"webhook", "slash_command"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE creator_id = ?", userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE o FROM event_outbox o JOIN event_subscription s ON o.subscription_id = s.id"+
+		" WHERE s.owner_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM event_subscription WHERE owner_id = ?", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// the generation was bumped above, this only drops the rows early
+	sessionsRevoked(userID)
+	if sessionStore != nil {
+		if err := sessionStore.DeleteForUser(userID); err != nil {
+			return err
+		}
+	}
+	invalidateSubscriptions()
+	for chanID, next := range successors {
+		channelCacher.AddMembers(channelKey(chanID), roleOwner, next)
+		peers.Broadcast(&PeerEvent{Type: peerEventMembersAdded, ChannelID: chanID, Members: []int64{next}, Role: roleOwner})
+	}
+	for _, chanID := range chanIDs {
+		channelCacher.RemoveMembers(channelKey(chanID), userID)
+		broadcaster.Publish(&StreamEvent{Type: streamEventMembersRemoved, ChannelID: chanID, Members: []int64{userID}})
+		peers.Broadcast(&PeerEvent{Type: peerEventMembersRemoved, ChannelID: chanID, Members: []int64{userID}})
+	}
+	return nil
+}
+
+// reservedUserName reports whether name may not be registered, because it
+// could clash with the name of a deleted user.
+func reservedUserName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), deletedNamePrefix)
+}
+
+// changeEmail starts changing the address of user to email. Resets are
+// mailed to that address, so it takes the current password like a password
+// change, and the new address is only used once the link mailed to it is
+// opened. The old address is told about it.
+func changeEmail(c echo.Context, user *User, email string) error {
+	if resetBaseURL() == "" {
+		return echo.ErrForbidden
+	}
+	// accounts from single sign-on have no password to check, the provider
+	// stands for them
+	if user.Password != "" {
+		nameKey := "login:name:" + user.Name
+		if err := checkLockout(c, "email_change_locked", nameKey); err != nil {
+			return err
+		}
+		ok, _, err := verifyPassword(user, c.FormValue("current_password"))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			recordFailure(map[string]*LockoutPolicy{nameKey: loginNamePolicy})
+			audit(c, "email_change_failed", map[string]interface{}{"user_id": user.ID})
+			return echo.ErrForbidden
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	// only the latest request counts
+	if _, err := db.Exec("DELETE FROM email_change WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO email_change (token_hash, user_id, email, expires_at, created_at) VALUES (?, ?, ?, ?, NOW())",
+		tokenHash(token), user.ID, email, time.Now().Add(emailChangeTTL)); err != nil {
+		return err
+	}
+	audit(c, "email_change_requested", map[string]interface{}{"user_id": user.ID})
+
+	body := fmt.Sprintf("%s さん\n\n以下のリンクを開くと、このアドレスがパスワード再設定用のメールアドレスになります。リンクは%d時間有効です。\n\n%s/email/confirm/%s\n\n"+
+		"心当たりがない場合はこのメールを無視してください。\n",
+		user.DisplayName, int(emailChangeTTL.Hours()), resetBaseURL(), token)
+	if err := mailer.Send(email, "メールアドレスの確認", body); err != nil {
+		return err
+	}
+	if user.Email != nil {
+		body := fmt.Sprintf("%s さん\n\nメールアドレスを %s に変更する手続きが行われました。\n\n"+
+			"心当たりがない場合はパスワードを変更し、すべての端末からログアウトしてください。\n", user.DisplayName, email)
+		if err := mailer.Send(*user.Email, "メールアドレスの変更", body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getEmailConfirm switches to the address the link was mailed to. Reset
+// links sent to the old address stop working.
+func getEmailConfirm(c echo.Context) error {
+	var change struct {
+		UserID int64  `db:"user_id"`
+		Email  string `db:"email"`
+	}
+	hash := tokenHash(c.Param("token"))
+	err := db.Get(&change, "SELECT user_id, email FROM email_change WHERE token_hash = ? AND expires_at > NOW()", hash)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "リンクが無効か、期限切れです")
+	} else if err != nil {
+		log.Println(err)
+		return err
+	}
+	// deleting the token claims it, so that it works only once
+	res, err := db.Exec("DELETE FROM email_change WHERE token_hash = ?", hash)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "リンクが無効か、期限切れです")
+	}
+
+	if _, err := db.Exec("UPDATE user SET email = ? WHERE id = ?", change.Email, change.UserID); err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM password_reset WHERE user_id = ?", change.UserID); err != nil {
+		log.Println(err)
+		return err
+	}
+	audit(c, "email_changed", map[string]interface{}{"user_id": change.UserID})
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// validEmail returns the bare address of s, "" if s isn't one.
+func validEmail(s string) string {
+	addr, err := mail.ParseAddress(strings.TrimSpace(s))
+	if err != nil || len(addr.Address) > 255 {
+		return ""
+	}
+	return addr.Address
+}
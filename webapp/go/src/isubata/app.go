@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	"crypto/sha1"
 	"database/sql"
@@ -11,6 +12,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
@@ -23,7 +25,6 @@ import (
 	"github.com/bytedance/sonic/decoder"
 	"github.com/bytedance/sonic/encoder"
 	"github.com/go-sql-driver/mysql"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -62,10 +63,15 @@ type Renderer struct {
 }
 
 func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if m, ok := data.(map[string]interface{}); ok {
+		m["CSRFToken"] = csrfToken(c)
+	}
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
-func init() {
+// initDB connects to the database named by the ISUBATA_DB_* variables,
+// waiting until it is up.
+func initDB() {
 	seedBuf := make([]byte, 8)
 	crand.Read(seedBuf)
 	rand.Seed(int64(binary.LittleEndian.Uint64(seedBuf)))
@@ -113,6 +119,9 @@ type User struct {
 	Password    string    `json:"-" db:"password"`
 	DisplayName string    `json:"display_name" db:"display_name"`
 	AvatarIcon  string    `json:"avatar_icon" db:"avatar_icon"`
+	IsBot       bool      `json:"is_bot" db:"is_bot"`
+	Email       *string   `json:"-" db:"email"`
+	SessionGen  int64     `json:"-" db:"session_gen"`
 	CreatedAt   time.Time `json:"-" db:"created_at"`
 }
 
@@ -123,30 +132,46 @@ func getUser(userID int64) (*User, error) {
 			return nil, nil
 		}
 		log.Println(err)
-		log.Println(err)
 		return nil, err
 	}
 	return &u, nil
 }
 
 func addMessage(channelID, userID int64, content string) (int64, error) {
+	now := time.Now()
 	res, err := db.Exec(
-		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, NOW())",
-		channelID, userID, content)
+		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, ?)",
+		channelID, userID, content, now)
 	if err != nil {
 		return 0, err
 	}
-	channelCacher.IncrementMessage(string(channelID))
-	return res.LastInsertId()
+	channelCacher.IncrementMessage(channelKey(channelID))
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	m := &Message{ID: id, ChannelID: channelID, UserID: userID, Content: content, CreatedAt: now}
+	if err := searchIndex.Index(m); err != nil {
+		log.Println(err)
+	}
+	peers.Broadcast(&PeerEvent{Type: peerEventMessageAdded, ChannelID: channelID, Message: m})
+	broadcaster.PublishMessage(m)
+	emitEvent(eventMessageCreated, channelID, messageEventData(m))
+	return id, nil
 }
 
 type Message struct {
-	ID        int64     `db:"id"`
-	ChannelID int64     `db:"channel_id"`
-	UserID    int64     `db:"user_id"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
-	User      *User     `db:"user"`
+	ID          int64      `db:"id"`
+	ChannelID   int64      `db:"channel_id"`
+	UserID      int64      `db:"user_id"`
+	Content     string     `db:"content"`
+	CreatedAt   time.Time  `db:"created_at"`
+	EditedAt    *time.Time `db:"edited_at"`
+	DeletedAt   *time.Time `db:"deleted_at"`
+	ParentID    *int64     `db:"parent_id"`
+	ReplyCnt    int32      `db:"reply_cnt"`
+	LastReplyAt *time.Time `db:"last_reply_at"`
+	User        *User      `db:"user"`
 }
 
 func queryMessages(chanID, lastID int64) ([]Message, error) {
@@ -156,22 +181,107 @@ func queryMessages(chanID, lastID int64) ([]Message, error) {
 	return msgs, err
 }
 
+// sessUserID returns the user the request acts for, logged in with a
+// session or authenticated with an API token.
 func sessUserID(c echo.Context) int64 {
+	if p := currentPrincipal(c); p != nil {
+		return p.UserID
+	}
+	return 0
+}
+
+func sessionUserID(c echo.Context) int64 {
 	sess, _ := session.Get("session", c)
 	var userID int64
-	if x, ok := sess.Values["user_id"]; ok {
-		userID, _ = x.(int64)
+	if sessionStore == nil {
+		if x, ok := sess.Values["user_id"]; ok {
+			userID, _ = x.(int64)
+		}
+	} else if id := currentSessionID(c); id != "" {
+		s, err := sessionStore.Get(id)
+		if err != nil {
+			log.Println(err)
+			return 0
+		}
+		if s != nil {
+			userID = s.UserID
+		}
+	}
+	if userID == 0 {
+		return 0
+	}
+
+	// sessions from before the last revocation of the user are void, also
+	// the ones only kept in a cookie or in the memory of another node
+	gen, _ := sess.Values["gen"].(int64)
+	current, err := querySessionGen(userID)
+	if err == sql.ErrNoRows {
+		return 0
+	} else if err != nil {
+		log.Println(err)
+		return 0
+	}
+	if gen != current {
+		return 0
 	}
 	return userID
 }
 
-func sessSetUserID(c echo.Context, id int64) {
+func sessSetUserID(c echo.Context, id int64) error {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		HttpOnly: true,
-		MaxAge:   360000,
+	sess.Options = sessionOptions()
+	// a new token for the new user, one planted before the login is useless
+	delete(sess.Values, csrfSessionKey)
+	gen, err := querySessionGen(id)
+	if err != nil {
+		return err
+	}
+	sess.Values["gen"] = gen
+	if sessionStore == nil {
+		sess.Values["user_id"] = id
+		return sess.Save(c.Request(), c.Response())
+	}
+
+	// a fresh token on every login, the old session is dropped
+	if old := currentSessionID(c); old != "" {
+		if err := sessionStore.Delete(old); err != nil {
+			return err
+		}
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return err
 	}
-	sess.Values["user_id"] = id
+	ua := c.Request().UserAgent()
+	if len(ua) > 255 {
+		ua = ua[:255]
+	}
+	now := time.Now()
+	if err := sessionStore.Create(&ServerSession{
+		ID:        sessionID(token),
+		UserID:    id,
+		UserAgent: ua,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(sessionMaxAge) * time.Second),
+	}); err != nil {
+		return err
+	}
+	sess.Values["token"] = token
+	return sess.Save(c.Request(), c.Response())
+}
+
+// sessClear logs the request out, revoking its server-side session.
+func sessClear(c echo.Context) {
+	if id := currentSessionID(c); id != "" && sessionStore != nil {
+		if err := sessionStore.Delete(id); err != nil {
+			log.Println(err)
+		}
+	}
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "user_id")
+	delete(sess.Values, "token")
+	delete(sess.Values, "gen")
+	delete(sess.Values, csrfSessionKey)
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -190,9 +300,7 @@ func ensureLogin(c echo.Context) (*User, error) {
 		return nil, err
 	}
 	if user == nil {
-		sess, _ := session.Get("session", c)
-		delete(sess.Values, "user_id")
-		sess.Save(c.Request(), c.Response())
+		sessClear(c)
 		goto redirect
 	}
 	return user, nil
@@ -215,17 +323,25 @@ func randomString(n int) string {
 }
 
 func register(name, password string) (int64, error) {
-	salt := randomString(20)
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+	digest, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
 
+	// the salt is part of the hash now, the column is kept for legacy digests
 	res, err := db.Exec(
 		"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
-			" VALUES (?, ?, ?, ?, ?, NOW())",
-		name, salt, digest, name, "default.png")
+			" VALUES (?, '', ?, ?, ?, NOW())",
+		name, digest, name, "default.png")
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	emitEvent(eventUserRegistered, 0, map[string]interface{}{"id": id, "name": name})
+	return id, nil
 }
 
 // request handlers
@@ -243,7 +359,31 @@ func getInitialize(c echo.Context) error {
 	db.MustExec("DELETE FROM image WHERE id > 1001")
 	db.MustExec("DELETE FROM channel WHERE id > 10")
 	db.MustExec("DELETE FROM message WHERE id > 10000")
+	db.MustExec("DELETE FROM message_revision WHERE message_id > 10000")
+	db.MustExec("UPDATE message SET deleted_at = NULL WHERE deleted_at IS NOT NULL")
+	db.MustExec("UPDATE message SET reply_cnt = 0, last_reply_at = NULL WHERE reply_cnt > 0")
+	db.MustExec("DELETE FROM thread_haveread")
+	db.MustExec("DELETE FROM mention")
+	db.MustExec("DELETE FROM reaction")
+	db.MustExec("DELETE FROM channel_member WHERE channel_id > 10")
 	db.MustExec("DELETE FROM haveread")
+	db.MustExec("DELETE FROM session")
+	db.MustExec("DELETE FROM api_token")
+	db.MustExec("DELETE FROM webhook")
+	db.MustExec("DELETE FROM slash_command")
+	db.MustExec("DELETE FROM webhook_rate")
+	db.MustExec("DELETE FROM scheduled_job")
+	db.MustExec("DELETE FROM user_identity")
+	db.MustExec("DELETE FROM user_totp")
+	db.MustExec("DELETE FROM recovery_code")
+	db.MustExec("DELETE FROM login_attempt")
+	db.MustExec("DELETE FROM password_reset")
+	db.MustExec("DELETE FROM email_change")
+	db.MustExec("UPDATE user SET email = NULL WHERE email IS NOT NULL")
+	db.MustExec("DELETE FROM event_subscription")
+	db.MustExec("DELETE FROM event_outbox")
+	subscriptionCacher.Flush()
+	sessionGenCacher.Flush()
 
 	if err := os.RemoveAll(iconPath); err != nil {
 		log.Println(err)
@@ -265,56 +405,47 @@ func getInitialize(c echo.Context) error {
 		}
 	}
 
-	channelCacher = initCannelCacher()
-	if _, err := db.Exec("UPDATE channel SET `message_cnt`=0"); err != nil {
+	if err := recountChannelMessages(); err != nil {
 		log.Println(err)
 		return err
 	}
-	if _, err := db.Exec("UPDATE channel, (SELECT channel_id, COUNT(*) AS `cnt` FROM message GROUP BY channel_id) AS summary SET `channel`.`message_cnt`=`summary`.`cnt` WHERE `channel`.`id` = `summary`.`channel_id`"); err != nil {
+	if err := loadChannelCache(); err != nil {
 		log.Println(err)
 		return err
 	}
-	channels := make([]*ChannelInfo, 0, 100)
-	if err := db.Select(&channels, "SELECT * FROM channel"); err != nil {
+	if err := searchIndex.Rebuild(); err != nil {
 		log.Println(err)
 		return err
 	}
-	for _, channel := range channels {
-		channelCacher.Set(string(channel.ID), channel, -1)
-	}
 
-	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, "http://172.31.5.58:5000/initialize/isu3", nil)
-	if err != nil {
-		panic(err)
-	}
-	_, err = http.DefaultClient.Do(req)
-	if err != nil {
+	if err := peers.BroadcastSync(c.Request().Context(), &PeerEvent{Type: peerEventInvalidate}); err != nil {
+		log.Println(err)
 		return err
 	}
 
 	return c.String(204, "")
 }
 
-func getInitializeIsu3(c echo.Context) error {
-	channelCacher = initCannelCacher()
-	if _, err := db.Exec("UPDATE channel SET `message_cnt`=0"); err != nil {
-		log.Println(err)
+func recountChannelMessages() error {
+	if _, err := db.Exec("UPDATE channel SET `message_cnt`=0, `deleted_cnt`=0"); err != nil {
 		return err
 	}
-	if _, err := db.Exec("UPDATE channel, (SELECT channel_id, COUNT(*) AS `cnt` FROM message GROUP BY channel_id) AS summary SET `channel`.`message_cnt`=`summary`.`cnt` WHERE `channel`.`id` = `summary`.`channel_id`"); err != nil {
-		log.Println(err)
-		return err
-	}
-	channels := make([]*ChannelInfo, 0, 100)
-	if err := db.Select(&channels, "SELECT * FROM channel"); err != nil {
-		log.Println(err)
-		return err
-	}
-	for _, channel := range channels {
-		channelCacher.Set(string(channel.ID), channel, -1)
-	}
+	_, err := db.Exec("UPDATE channel, (SELECT channel_id, SUM(deleted_at IS NULL) AS `cnt`, SUM(deleted_at IS NOT NULL) AS `deleted` FROM message WHERE parent_id IS NULL GROUP BY channel_id) AS summary SET `channel`.`message_cnt`=`summary`.`cnt`, `channel`.`deleted_cnt`=`summary`.`deleted` WHERE `channel`.`id` = `summary`.`channel_id`")
+	return err
+}
 
-	return c.String(204, "")
+func loadChannelCache() error {
+	return channelCacher.Reload(func() ([]*ChannelInfo, []*ChannelMember, error) {
+		channels := make([]*ChannelInfo, 0, 100)
+		if err := db.Select(&channels, "SELECT * FROM channel"); err != nil {
+			return nil, nil, err
+		}
+		members := make([]*ChannelMember, 0)
+		if err := db.Select(&members, "SELECT channel_id, user_id, role FROM channel_member"); err != nil {
+			return nil, nil, err
+		}
+		return channels, members, nil
+	})
 }
 
 func getIndex(c echo.Context) error {
@@ -333,8 +464,14 @@ type ChannelInfo struct {
 	Name        string    `db:"name"`
 	Description string    `db:"description"`
 	MessageCnt  int32     `db:"message_cnt"`
+	DeletedCnt  int32     `db:"deleted_cnt"`
+	Kind        string    `db:"kind"`
+	DMKey       *string   `db:"dm_key"`
 	UpdatedAt   time.Time `db:"updated_at"`
 	CreatedAt   time.Time `db:"created_at"`
+
+	// user id -> role of the channel members, guarded by the ChannelCacher mutex
+	Members map[int64]string `db:"-" json:"-"`
 }
 
 func getChannel(c echo.Context) error {
@@ -348,27 +485,64 @@ func getChannel(c echo.Context) error {
 		log.Println(err)
 		return err
 	}
-	channels := channelCacher.GetAll()
+	if ok, err := authorize(user.ID, int64(cID), ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+	channels := channelCacher.GetAllFor(user.ID)
 	sort.Slice(channels, func(i, j int) bool {
 		return channels[i].ID < channels[j].ID
 	})
 
-	var desc string
+	var desc, kind string
 	for _, ch := range channels {
 		if ch.ID == int64(cID) {
 			desc = ch.Description
+			kind = ch.Kind
 			break
 		}
 	}
+	var members []*MemberInfo
+	if kind == channelKindPrivate {
+		if members, err = queryChannelMembers(int64(cID)); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	canEdit, err := authorize(user.ID, int64(cID), ActionEditChannel, 0)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	canSetRole, err := authorize(user.ID, int64(cID), ActionSetRole, 0)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	canManageWebhooks, err := authorize(user.ID, int64(cID), ActionManageWebhooks, 0)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
 	return c.Render(http.StatusOK, "channel", map[string]interface{}{
 		"ChannelID":   cID,
 		"Channels":    channels,
 		"User":        user,
 		"Description": desc,
+		"Private":     kind == channelKindPrivate,
+		"Members":     members,
+		"CanEdit":     canEdit,
+		"CanSetRole":  canSetRole,
+		"CanWebhooks": canManageWebhooks,
 	})
 }
 
 func getRegister(c echo.Context) error {
+	if !passwordLogin {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
 	return c.Render(http.StatusOK, "register", map[string]interface{}{
 		"ChannelID": 0,
 		"Channels":  []ChannelInfo{},
@@ -377,61 +551,124 @@ func getRegister(c echo.Context) error {
 }
 
 func postRegister(c echo.Context) error {
+	if !passwordLogin {
+		return echo.ErrForbidden
+	}
+	ipKey := "register:ip:" + c.RealIP()
+	if err := checkLockout(c, "register_locked", ipKey); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
 	name := c.FormValue("name")
 	pw := c.FormValue("password")
-	if name == "" || pw == "" {
+	if name == "" || pw == "" || reservedUserName(name) {
 		return ErrBadReqeust
 	}
 	userID, err := register(name, pw)
 	if err != nil {
 		if merr, ok := err.(*mysql.MySQLError); ok {
 			if merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
+				// only taken names count, so that one address can't probe
+				// for them while sign-ups themselves are never held up
+				recordFailure(map[string]*LockoutPolicy{ipKey: registerIPPolicy})
+				audit(c, "register_failed", map[string]interface{}{"name": name, "reason": "name_taken"})
 				return c.NoContent(http.StatusConflict)
 			}
 		}
 		log.Println(err)
 		return err
 	}
-	sessSetUserID(c, userID)
+	if err := sessSetUserID(c, userID); err != nil {
+		log.Println(err)
+		return err
+	}
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
 func getLogin(c echo.Context) error {
 	return c.Render(http.StatusOK, "login", map[string]interface{}{
-		"ChannelID": 0,
-		"Channels":  []ChannelInfo{},
-		"User":      nil,
+		"ChannelID":     0,
+		"Channels":      []ChannelInfo{},
+		"User":          nil,
+		"OIDC":          oidcProvider != nil,
+		"PasswordLogin": passwordLogin,
+		"PasswordReset": resetBaseURL() != "",
 	})
 }
 
 func postLogin(c echo.Context) error {
+	if !passwordLogin {
+		return echo.ErrForbidden
+	}
 	name := c.FormValue("name")
 	pw := c.FormValue("password")
 	if name == "" || pw == "" {
 		return ErrBadReqeust
 	}
+	ipKey, nameKey := "login:ip:"+c.RealIP(), "login:name:"+name
+	if err := checkLockout(c, "login_locked", ipKey, nameKey); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+	fail := func(reason string) error {
+		recordFailure(map[string]*LockoutPolicy{ipKey: loginIPPolicy, nameKey: loginNamePolicy})
+		audit(c, "login_failed", map[string]interface{}{"name": name, "reason": reason})
+		return echo.ErrForbidden
+	}
 
 	var user User
 	err := db.Get(&user, "SELECT * FROM user WHERE name = ?", name)
 	if err == sql.ErrNoRows {
-		return echo.ErrForbidden
+		return fail("unknown_user")
 	} else if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
-	if digest != user.Password {
-		return echo.ErrForbidden
+	// bots and users created by single sign-on have no password
+	if user.IsBot || user.Password == "" {
+		return fail("no_password")
+	}
+	ok, rehash, err := verifyPassword(&user, pw)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !ok {
+		return fail("wrong_password")
+	}
+	// only the account is cleared, a valid login must not reset the
+	// counter of an address trying many accounts
+	if err := attemptStore.Reset(nameKey); err != nil {
+		log.Println(err)
+	}
+	if rehash {
+		// a failed upgrade is retried on the next login
+		if digest, err := hashPassword(pw); err != nil {
+			log.Println(err)
+		} else if _, err := db.Exec("UPDATE user SET salt = '', password = ? WHERE id = ?", digest, user.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	if t, err := queryTOTP(user.ID); err != nil {
+		log.Println(err)
+		return err
+	} else if t != nil && t.Enabled {
+		return beginSecondFactor(c, user.ID)
+	}
+	if err := sessSetUserID(c, user.ID); err != nil {
+		log.Println(err)
+		return err
 	}
-	sessSetUserID(c, user.ID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
 func getLogout(c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+	sessClear(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -442,11 +679,6 @@ func postMessage(c echo.Context) error {
 		return err
 	}
 
-	message := c.FormValue("message")
-	if message == "" {
-		return echo.ErrForbidden
-	}
-
 	var chanID int64
 	if x, err := strconv.Atoi(c.FormValue("channel_id")); err != nil {
 		return echo.ErrForbidden
@@ -454,34 +686,460 @@ func postMessage(c echo.Context) error {
 		chanID = int64(x)
 	}
 
-	if _, err := addMessage(chanID, user.ID, message); err != nil {
+	var parentID int64
+	if s := c.FormValue("parent_id"); s != "" {
+		if parentID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	_, reply, err := sendMessage(user, chanID, parentID, c.FormValue("message"))
+	if err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+	if reply == "" {
+		return c.NoContent(204)
+	}
+	// shown to the sender only, nothing is stored
+	return c.JSON(http.StatusOK, map[string]interface{}{"ephemeral": reply})
+}
+
+func putMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	content := c.FormValue("message")
+	if content == "" {
+		return ErrBadReqeust
+	}
+
+	m, err := editMessage(userID, msgID, content)
+	if err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, messageJSON(m))
+}
+
+// editMessage replaces the content of a message written by userID and keeps
+// the previous content as a message_revision row.
+func editMessage(userID, msgID int64, content string) (*Message, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m := Message{}
+	err = tx.Get(&m, "SELECT * FROM message WHERE id = ? AND deleted_at IS NULL FOR UPDATE", msgID)
+	if err == sql.ErrNoRows {
+		return nil, echo.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if ok, err := authorize(userID, m.ChannelID, ActionEditMessage, m.UserID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, echo.ErrForbidden
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO message_revision (message_id, channel_id, content, created_at) VALUES (?, ?, ?, ?)",
+		m.ID, m.ChannelID, m.Content, now); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE message SET content = ?, edited_at = ? WHERE id = ?", content, now, m.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.Content = content
+	m.EditedAt = &now
+	if err := searchIndex.Index(&m); err != nil {
+		log.Println(err)
+	}
+	// users newly mentioned by the edit are notified, earlier mentions stay
+	if err := addMentions(m.ChannelID, m.ID, m.ParentID, m.UserID, content); err != nil {
+		log.Println(err)
+	}
+	if m.User, err = getUser(m.UserID); err != nil {
+		return nil, err
+	}
+	peers.Broadcast(&PeerEvent{Type: peerEventMessageEdited, ChannelID: m.ChannelID, Message: &m})
+	broadcaster.Publish(&StreamEvent{Type: streamEventMessageEdited, ChannelID: m.ChannelID, Message: &m})
+	return &m, nil
+}
+
+func deleteMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	if err := softDeleteMessage(userID, msgID); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// softDeleteMessage marks a message as deleted. The author and the
+// moderators of the channel may delete it. The tr2 trigger moves the message from
+// channel.message_cnt to channel.deleted_cnt.
+func softDeleteMessage(userID, msgID int64) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	m := Message{}
+	err = tx.Get(&m, "SELECT * FROM message WHERE id = ? AND deleted_at IS NULL FOR UPDATE", msgID)
+	if err == sql.ErrNoRows {
+		return echo.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if ok, err := authorize(userID, m.ChannelID, ActionDeleteMessage, m.UserID); err != nil {
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	// the revision row moves the edit cursor so polling clients see the tombstone
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO message_revision (message_id, channel_id, content, created_at) VALUES (?, ?, ?, ?)",
+		m.ID, m.ChannelID, m.Content, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE message SET deleted_at = ? WHERE id = ?", now, m.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if m.ParentID == nil {
+		channelCacher.DecrementMessage(channelKey(m.ChannelID))
+	}
+	m.DeletedAt = &now
+	if err := searchIndex.Remove(m.ID); err != nil {
 		log.Println(err)
+	}
+	if m.User, err = getUser(m.UserID); err != nil {
 		return err
 	}
+	peers.Broadcast(&PeerEvent{Type: peerEventMessageDeleted, ChannelID: m.ChannelID, Message: &m})
+	broadcaster.Publish(&StreamEvent{Type: streamEventMessageEdited, ChannelID: m.ChannelID, Message: &m})
+	return nil
+}
 
-	return c.NoContent(204)
+type EditedMessage struct {
+	Message
+	RevisionID int64 `db:"revision_id"`
 }
 
-func jsonifyMessage(m Message) (map[string]interface{}, error) {
-	u := User{}
-	err := db.Get(&u, "SELECT name, display_name, avatar_icon FROM user WHERE id = ?",
-		m.UserID)
+func queryEditedMessages(chanID, lastRevID, lastID int64) ([]*EditedMessage, error) {
+	msgs := make([]*EditedMessage, 0)
+	err := db.Select(&msgs, "SELECT m.*, r.revision_id, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot`"+
+		" FROM (SELECT message_id, MAX(id) AS revision_id FROM message_revision WHERE channel_id = ? AND id > ? GROUP BY message_id) r"+
+		" JOIN message m ON m.id = r.message_id JOIN user u ON m.user_id = u.id"+
+		" WHERE m.id <= ? AND m.parent_id IS NULL ORDER BY m.id",
+		chanID, lastRevID, lastID)
+	return msgs, err
+}
+
+func queryMaxRevisionID(chanID int64) (int64, error) {
+	var id int64
+	err := db.Get(&id, "SELECT COALESCE(MAX(id), 0) FROM message_revision WHERE channel_id = ?", chanID)
+	return id, err
+}
+
+// createMessage validates and stores a message posted by user, as a thread
+// reply when parentID is not 0. Validation failures are returned as
+// *echo.HTTPError.
+func createMessage(user *User, chanID, parentID int64, content string) (int64, error) {
+	if content == "" {
+		return 0, echo.ErrForbidden
+	}
+	if ok, err := authorize(user.ID, chanID, ActionPost, 0); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, echo.ErrForbidden
+	}
+	return storeMessage(user.ID, chanID, parentID, content)
+}
+
+// storeMessage adds a message or, with parentID, a reply without checking
+// that userID may post in the channel.
+func storeMessage(userID, chanID, parentID int64, content string) (int64, error) {
+	var id int64
+	var err error
+	if parentID == 0 {
+		if id, err = addMessage(chanID, userID, content); err != nil {
+			return 0, err
+		}
+		// the message is stored already, a lost mention must not fail the post
+		if err := addMentions(chanID, id, nil, userID, content); err != nil {
+			log.Println(err)
+		}
+		return id, nil
+	}
+
+	parent, err := queryMessageWithUser(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if parent == nil || parent.ChannelID != chanID || parent.ParentID != nil || parent.DeletedAt != nil {
+		return 0, ErrBadReqeust
+	}
+	if id, err = addReply(chanID, parentID, userID, content); err != nil {
+		return 0, err
+	}
+	if err := addMentions(chanID, id, &parentID, userID, content); err != nil {
+		log.Println(err)
+	}
+	return id, nil
+}
+
+func addReply(channelID, parentID, userID int64, content string) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec(
+		"INSERT INTO message (channel_id, user_id, content, parent_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		channelID, userID, content, parentID, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE message SET reply_cnt = reply_cnt + 1, last_reply_at = ? WHERE id = ?", now, parentID); err != nil {
+		return 0, err
+	}
+	// the author has obviously read the thread they are replying to
+	if _, err := tx.Exec("INSERT INTO thread_haveread (user_id, message_id, read_cnt, updated_at, created_at)"+
+		" SELECT ?, id, reply_cnt, NOW(), NOW() FROM message WHERE id = ?"+
+		" ON DUPLICATE KEY UPDATE read_cnt = VALUES(read_cnt), updated_at = NOW()",
+		userID, parentID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	m := &Message{ID: id, ChannelID: channelID, UserID: userID, Content: content, ParentID: &parentID, CreatedAt: now}
+	if err := searchIndex.Index(m); err != nil {
+		log.Println(err)
+	}
+	peers.Broadcast(&PeerEvent{Type: peerEventMessageAdded, ChannelID: channelID, Message: m})
+	broadcaster.PublishMessage(m)
+	emitEvent(eventMessageCreated, channelID, messageEventData(m))
+
+	parent, err := queryMessageWithUser(parentID)
+	if err != nil {
+		log.Println(err)
+	} else if parent != nil {
+		peers.Broadcast(&PeerEvent{Type: peerEventMessageEdited, ChannelID: channelID, Message: parent})
+		broadcaster.Publish(&StreamEvent{Type: streamEventMessageEdited, ChannelID: channelID, Message: parent})
+	}
+	return id, nil
+}
+
+func queryMessageWithUser(msgID int64) (*Message, error) {
+	m := Message{}
+	err := db.Get(&m, "SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot` FROM message m JOIN user u ON m.user_id = u.id WHERE m.id = ?", msgID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func queryReplies(parentID, lastID int64) ([]*Message, error) {
+	msgs := make([]*Message, 0)
+	err := db.Select(&msgs, "SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot` FROM message m JOIN user u ON m.user_id = u.id WHERE m.parent_id = ? AND m.id > ? ORDER BY m.id DESC",
+		parentID, lastID)
+	return msgs, err
+}
+
+func queryThreadReads(userID int64, msgIDs []int64) (map[int64]int32, error) {
+	reads := make(map[int64]int32, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return reads, nil
+	}
+	query, args, err := sqlx.In("SELECT message_id, read_cnt FROM thread_haveread WHERE user_id = ? AND message_id IN (?)", userID, msgIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		MessageID int64 `db:"message_id"`
+		ReadCnt   int32 `db:"read_cnt"`
+	}{}
+	if err := db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		reads[r.MessageID] = r.ReadCnt
+	}
+	return reads, nil
+}
+
+func getThread(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	var lastID int64
+	if s := c.QueryParam("last_reply_id"); s != "" {
+		if lastID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	parent, err := queryMessageWithUser(msgID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if parent == nil || parent.ParentID != nil {
+		return echo.ErrNotFound
+	}
+	if ok, err := authorize(userID, parent.ChannelID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	replies, err := queryReplies(parent.ID, lastID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	rjson, err := messagesJSON(userID, replies)
 	if err != nil {
 		log.Println(err)
+		return err
+	}
+
+	if _, err := db.Exec("INSERT INTO thread_haveread (user_id, message_id, read_cnt, updated_at, created_at)"+
+		" VALUES (?, ?, ?, NOW(), NOW())"+
+		" ON DUPLICATE KEY UPDATE read_cnt = ?, updated_at = NOW()",
+		userID, parent.ID, parent.ReplyCnt, parent.ReplyCnt); err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := db.Exec("UPDATE mention SET read_at = NOW() WHERE user_id = ? AND parent_id = ? AND read_at IS NULL",
+		userID, parent.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"parent":  messageJSON(parent),
+		"replies": rjson,
+	})
+}
+
+func messageJSON(m *Message) map[string]interface{} {
+	var editedAt interface{}
+	if m.EditedAt != nil {
+		editedAt = m.EditedAt.Format("2006/01/02 15:04:05")
+	}
+	content := m.Content
+	if m.DeletedAt != nil {
+		content = ""
+	}
+	var lastReplyAt interface{}
+	if m.LastReplyAt != nil {
+		lastReplyAt = m.LastReplyAt.Format("2006/01/02 15:04:05")
+	}
+	return map[string]interface{}{
+		"id":            m.ID,
+		"user":          m.User,
+		"date":          m.CreatedAt.Format("2006/01/02 15:04:05"),
+		"content":       content,
+		"edited_at":     editedAt,
+		"deleted":       m.DeletedAt != nil,
+		"parent_id":     m.ParentID,
+		"reply_count":   m.ReplyCnt,
+		"last_reply_at": lastReplyAt,
+	}
+}
+
+// messagesJSON converts msgs, ordered by id DESC, to the JSON of the
+// /message API in ascending order, with per-user thread state and reactions
+// attached.
+func messagesJSON(userID int64, msgs []*Message) ([]map[string]interface{}, error) {
+	msgIDs := make([]int64, 0, len(msgs))
+	threadIDs := make([]int64, 0)
+	for _, m := range msgs {
+		msgIDs = append(msgIDs, m.ID)
+		if m.ReplyCnt > 0 {
+			threadIDs = append(threadIDs, m.ID)
+		}
+	}
+	reads, err := queryThreadReads(userID, threadIDs)
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := queryReactions(userID, msgIDs)
+	if err != nil {
 		return nil, err
 	}
 
-	r := make(map[string]interface{})
-	r["id"] = m.ID
-	r["user"] = u
-	r["date"] = m.CreatedAt.Format("2006/01/02 15:04:05")
-	r["content"] = m.Content
-	return r, nil
+	res := make([]map[string]interface{}, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		r := messageJSON(msgs[i])
+		if msgs[i].ReplyCnt > 0 {
+			r["thread_unread"] = msgs[i].ReplyCnt - reads[msgs[i].ID]
+		}
+		if rs, ok := reactions[msgs[i].ID]; ok {
+			r["reactions"] = rs
+		} else {
+			r["reactions"] = []map[string]interface{}{}
+		}
+		res = append(res, r)
+	}
+	return res, nil
 }
 
 func querymessagesWithUsers(chanID, lastID int64, limit, offset int32) ([]*Message, error) {
 	msgs := make([]*Message, 0)
-	query := "SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name` FROM message m JOIN user u ON m.user_id = u.id WHERE m.channel_id = ?"
+	query := "SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot` FROM message m JOIN user u ON m.user_id = u.id WHERE m.channel_id = ? AND m.parent_id IS NULL"
 
 	args := []interface{}{chanID}
 	if lastID > 0 {
@@ -520,6 +1178,12 @@ func getMessage(c echo.Context) error {
 		log.Println(err)
 		return err
 	}
+	if ok, err := authorize(userID, chanID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return c.NoContent(http.StatusForbidden)
+	}
 
 	messages, err := querymessagesWithUsers(chanID, lastID, 100, 0)
 	if err != nil {
@@ -527,25 +1191,43 @@ func getMessage(c echo.Context) error {
 		return err
 	}
 
-	response := make([]map[string]interface{}, 0, len(messages))
-	for i := len(messages) - 1; i >= 0; i-- {
-		message := messages[i]
-		response = append(response,
-			map[string]interface{}{
-				"id":      message.ID,
-				"user":    message.User,
-				"date":    message.CreatedAt.Format("2006/01/02 15:04:05"),
-				"content": message.Content,
-			},
-		)
+	// Clients passing last_revision_id also receive messages they already
+	// have but which were edited since, flagged with "revision_id".
+	maxRevID, err := queryMaxRevisionID(chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	c.Response().Header().Set("X-Last-Revision-Id", strconv.FormatInt(maxRevID, 10))
+
+	var edited []*EditedMessage
+	if s := c.QueryParam("last_revision_id"); s != "" {
+		lastRevID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+		edited, err = queryEditedMessages(chanID, lastRevID, lastID)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	response := make([]map[string]interface{}, 0, len(edited)+len(messages))
+	for _, e := range edited {
+		r := messageJSON(&e.Message)
+		r["revision_id"] = e.RevisionID
+		response = append(response, r)
+	}
+	mjson, err := messagesJSON(userID, messages)
+	if err != nil {
+		log.Println(err)
+		return err
 	}
+	response = append(response, mjson...)
 
 	if len(messages) > 0 {
-		_, err := db.Exec("INSERT INTO haveread (user_id, channel_id, message_id, updated_at, created_at)"+
-			" VALUES (?, ?, ?, NOW(), NOW())"+
-			" ON DUPLICATE KEY UPDATE message_id = ?, updated_at = NOW()",
-			userID, chanID, messages[0].ID, messages[0].ID)
-		if err != nil {
+		if err := markHaveRead(userID, chanID, messages[0].ID); err != nil {
 			log.Println(err)
 			return err
 		}
@@ -554,8 +1236,24 @@ func getMessage(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
-func queryChannels() ([]*ChannelInfo, error) {
-	return channelCacher.GetAll(), nil
+// markHaveRead records that userID has seen the channel up to messageID,
+// along with the mentions in it. Mentions in threads are read with the thread.
+func markHaveRead(userID, chanID, messageID int64) error {
+	_, err := db.Exec("INSERT INTO haveread (user_id, channel_id, message_id, updated_at, created_at)"+
+		" VALUES (?, ?, ?, NOW(), NOW())"+
+		" ON DUPLICATE KEY UPDATE message_id = ?, updated_at = NOW()",
+		userID, chanID, messageID, messageID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE mention SET read_at = NOW()"+
+		" WHERE user_id = ? AND channel_id = ? AND parent_id IS NULL AND message_id <= ? AND read_at IS NULL",
+		userID, chanID, messageID)
+	return err
+}
+
+func queryChannels(userID int64) ([]*ChannelInfo, error) {
+	return channelCacher.GetAllFor(userID), nil
 }
 
 type HaveRead struct {
@@ -598,11 +1296,20 @@ func fetchUnread(c echo.Context) error {
 		return c.NoContent(http.StatusForbidden)
 	}
 
-	channels, err := queryChannels()
+	resp, err := queryUnreads(userID)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func queryUnreads(userID int64) ([]map[string]interface{}, error) {
+	channels, err := queryChannels(userID)
+	if err != nil {
+		return nil, err
+	}
 	channelMap := make(map[int64]*ChannelInfo, len(channels))
 	for _, channel := range channels {
 		channelMap[channel.ID] = channel
@@ -610,15 +1317,18 @@ func fetchUnread(c echo.Context) error {
 
 	haveUnreads, err := queryHaveReads(userID)
 	if err != nil {
-		log.Println(err)
-		log.Println(err)
-		return err
+		return nil, err
 	}
 	haveUnreadMap := make(map[int64]*HaveRead, len(haveUnreads))
 	for _, haveUnread := range haveUnreads {
 		haveUnreadMap[haveUnread.ChannelID] = haveUnread
 	}
 
+	mentionCnts, err := queryMentionCounts(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	resp := []map[string]interface{}{}
 
 	for _, channel := range channels {
@@ -631,24 +1341,98 @@ func fetchUnread(c echo.Context) error {
 		var cnt int64
 		if lastID > 0 {
 			err = db.Get(&cnt,
-				"SELECT COUNT(*) as cnt FROM message WHERE channel_id = ? AND ? < id",
+				"SELECT COUNT(*) as cnt FROM message WHERE channel_id = ? AND ? < id AND deleted_at IS NULL AND parent_id IS NULL",
 				channel.ID, lastID)
 		} else {
 			cnt = int64(channelMap[channel.ID].MessageCnt)
 		}
 		if err != nil {
-			log.Println(err)
-			return err
+			return nil, err
 		}
 		r := map[string]interface{}{
 			"channel_id": channel.ID,
-			"unread":     cnt}
+			"unread":     cnt,
+			"mentions":   mentionCnts[channel.ID]}
 		resp = append(resp, r)
 	}
 
-	return c.JSON(http.StatusOK, resp)
+	return resp, nil
+}
+
+const historyPerPage = 20
+
+type HistoryPage struct {
+	// newest first
+	Messages []*Message
+	// cursors of the neighbouring pages, 0 if there is none
+	BeforeID int64
+	AfterID  int64
+}
+
+// queryHistory reads limit top-level messages of a channel, tombstones
+// included, older than cursor or newer than it when after is set. A zero
+// cursor without after reads the newest messages.
+func queryHistory(chanID, cursor int64, after bool, limit int) (*HistoryPage, error) {
+	query := "SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot`" +
+		" FROM message m JOIN user u ON m.user_id = u.id WHERE m.channel_id = ? AND m.parent_id IS NULL"
+	if !after && cursor == 0 {
+		cursor = math.MaxInt64
+	}
+	msgs := make([]*Message, 0, limit+1)
+	var err error
+	if after {
+		err = db.Select(&msgs, query+" AND m.id > ? ORDER BY m.id LIMIT ?", chanID, cursor, limit+1)
+	} else {
+		err = db.Select(&msgs, query+" AND m.id < ? ORDER BY m.id DESC LIMIT ?", chanID, cursor, limit+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	more := len(msgs) > limit
+	if more {
+		msgs = msgs[:limit]
+	}
+	if after {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+
+	// one side is known from the extra row, the other needs a look
+	p := &HistoryPage{Messages: msgs}
+	var exists bool
+	if after {
+		bound := cursor + 1
+		if len(msgs) > 0 {
+			bound = msgs[len(msgs)-1].ID
+			if more {
+				p.AfterID = msgs[0].ID
+			}
+		}
+		err = db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM message WHERE channel_id = ? AND parent_id IS NULL AND id < ?)", chanID, bound)
+		if exists {
+			p.BeforeID = bound
+		}
+	} else {
+		bound := cursor - 1
+		if len(msgs) > 0 {
+			bound = msgs[0].ID
+			if more {
+				p.BeforeID = msgs[len(msgs)-1].ID
+			}
+		}
+		err = db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM message WHERE channel_id = ? AND parent_id IS NULL AND id > ?)", chanID, bound)
+		if exists {
+			p.AfterID = bound
+		}
+	}
+	return p, err
 }
 
+// getHistory shows the history of a channel, newest first. Pages are
+// addressed by the before_id/after_id cursors or by a date to jump to, the
+// old ?page= offsets keep working. The cursor pages are served as JSON when
+// Accept asks for it.
 func getHistory(c echo.Context) error {
 	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
 	if err != nil || chID <= 0 {
@@ -660,23 +1444,88 @@ func getHistory(c echo.Context) error {
 		log.Println(err)
 		return err
 	}
+	if ok, err := authorize(user.ID, chID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
 
-	var page int64
-	pageStr := c.QueryParam("page")
-	if pageStr == "" {
-		page = 1
-	} else {
-		page, err = strconv.ParseInt(pageStr, 10, 64)
-		if err != nil || page < 1 {
+	if c.QueryParam("page") != "" {
+		return getHistoryPage(c, user, chID)
+	}
+
+	var cursor int64
+	var after bool
+	if s := c.QueryParam("after_id"); s != "" {
+		after = true
+		if cursor, err = strconv.ParseInt(s, 10, 64); err != nil || cursor < 0 {
 			return ErrBadReqeust
 		}
+	} else if s := c.QueryParam("before_id"); s != "" {
+		if cursor, err = strconv.ParseInt(s, 10, 64); err != nil || cursor < 0 {
+			return ErrBadReqeust
+		}
+	} else if s := c.QueryParam("date"); s != "" {
+		date, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return ErrBadReqeust
+		}
+		after = true
+		if err := db.Get(&cursor, "SELECT COALESCE(MAX(id), 0) FROM message"+
+			" WHERE channel_id = ? AND parent_id IS NULL AND created_at < ?", chID, date); err != nil {
+			log.Println(err)
+			return err
+		}
 	}
 
-	const N = 20
+	p, err := queryHistory(chID, cursor, after, historyPerPage)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	mjson, err := messagesJSON(user.ID, p.Messages)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"messages":  mjson,
+			"before_id": p.BeforeID,
+			"after_id":  p.AfterID,
+		})
+	}
+
+	channels := channelCacher.GetAllFor(user.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+
+	return c.Render(http.StatusOK, "history", map[string]interface{}{
+		"ChannelID": chID,
+		"Channels":  channels,
+		"Messages":  mjson,
+		"BeforeID":  p.BeforeID,
+		"AfterID":   p.AfterID,
+		"User":      user,
+	})
+}
+
+// getHistoryPage serves the offset based ?page= URLs.
+func getHistoryPage(c echo.Context, user *User, chID int64) error {
+	page, err := strconv.ParseInt(c.QueryParam("page"), 10, 64)
+	if err != nil || page < 1 {
+		return ErrBadReqeust
+	}
+
+	const N = historyPerPage
 	var cnt int32
-	channel, ok := channelCacher.Get(string(chID))
+	channel, ok := channelCacher.Get(channelKey(chID))
 	if ok {
-		cnt = channel.MessageCnt
+		// deleted messages stay in the history as tombstones
+		cnt = channel.MessageCnt + channel.DeletedCnt
 	}
 	maxPage := int64(cnt+N-1) / N
 	if maxPage == 0 {
@@ -692,18 +1541,13 @@ func getHistory(c echo.Context) error {
 		return err
 	}
 
-	mjson := make([]map[string]interface{}, 0, len(messages))
-	for i := len(messages) - 1; i >= 0; i-- {
-		message := messages[i]
-		mjson = append(mjson, map[string]interface{}{
-			"id":      message.ID,
-			"user":    message.User,
-			"date":    message.CreatedAt.Format("2006/01/02 15:04:05"),
-			"content": message.Content,
-		})
+	mjson, err := messagesJSON(user.ID, messages)
+	if err != nil {
+		log.Println(err)
+		return err
 	}
 
-	channels := channelCacher.GetAll()
+	channels := channelCacher.GetAllFor(user.ID)
 	sort.Slice(channels, func(i, j int) bool {
 		return channels[i].ID < channels[j].ID
 	})
@@ -725,7 +1569,7 @@ func getProfile(c echo.Context) error {
 		return err
 	}
 
-	channels := channelCacher.GetAll()
+	channels := channelCacher.GetAllFor(self.ID)
 	sort.Slice(channels, func(i, j int) bool {
 		return channels[i].ID < channels[j].ID
 	})
@@ -741,12 +1585,41 @@ func getProfile(c echo.Context) error {
 		return err
 	}
 
+	var userSessions []*ServerSession
+	if self.ID == other.ID && sessionStore != nil {
+		if userSessions, err = sessionStore.ListForUser(self.ID); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	var tokens []*APIToken
+	if self.ID == other.ID {
+		if tokens, err = queryAPITokens(self.ID); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	totp, err := queryTOTP(other.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
 	return c.Render(http.StatusOK, "profile", map[string]interface{}{
-		"ChannelID":   0,
-		"Channels":    channels,
-		"User":        self,
-		"Other":       other,
-		"SelfProfile": self.ID == other.ID,
+		"ChannelID":      0,
+		"Channels":       channels,
+		"User":           self,
+		"Other":          other,
+		"SelfProfile":    self.ID == other.ID,
+		"ServerSessions": sessionStore != nil,
+		"Sessions":       userSessions,
+		"CurrentSession": currentSessionID(c),
+		"Tokens":         tokens,
+		"OIDC":           oidcProvider != nil,
+		"TOTPEnabled":    totp != nil && totp.Enabled,
+		"HasPassword":    self.Password != "",
+		"EmailChange":    resetBaseURL() != "",
+		"Admin":          isAdmin(self),
 	})
 }
 
@@ -757,7 +1630,7 @@ func getAddChannel(c echo.Context) error {
 		return err
 	}
 
-	channels := channelCacher.GetAll()
+	channels := channelCacher.GetAllFor(self.ID)
 	sort.Slice(channels, func(i, j int) bool {
 		return channels[i].ID < channels[j].ID
 	})
@@ -781,11 +1654,26 @@ func postAddChannel(c echo.Context) error {
 	if name == "" || desc == "" {
 		return ErrBadReqeust
 	}
+	kind := channelKindPublic
+	switch c.FormValue("visibility") {
+	case "", channelKindPublic:
+	case channelKindPrivate:
+		kind = channelKindPrivate
+	default:
+		return ErrBadReqeust
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
 
 	now := time.Now()
-	res, err := db.Exec(
-		"INSERT INTO channel (name, description, updated_at, created_at) VALUES (?, ?, ?, ?)",
-		name, desc, now, now)
+	res, err := tx.Exec(
+		"INSERT INTO channel (name, description, kind, updated_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		name, desc, kind, now, now)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -793,12 +1681,78 @@ func postAddChannel(c echo.Context) error {
 
 	lastID, _ := res.LastInsertId()
 
-	channelCacher.Set(string(lastID), &ChannelInfo{ID: lastID, Name: name, Description: desc, MessageCnt: 0, UpdatedAt: now, CreatedAt: now}, -1)
+	if _, err := tx.Exec("INSERT INTO channel_member (channel_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		lastID, self.ID, roleOwner, now); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	channel := &ChannelInfo{ID: lastID, Name: name, Description: desc, MessageCnt: 0, Kind: kind, UpdatedAt: now, CreatedAt: now}
+	channelCacher.Set(channelKey(lastID), channel, -1)
+	channelCacher.AddMembers(channelKey(lastID), roleOwner, self.ID)
+	peers.Broadcast(&PeerEvent{Type: peerEventChannelCreated, ChannelID: lastID, Channel: channel, Members: []int64{self.ID}, Role: roleOwner})
+	emitEvent(eventChannelCreated, lastID, map[string]interface{}{
+		"id":          lastID,
+		"name":        name,
+		"description": desc,
+		"kind":        kind,
+		"creator_id":  self.ID,
+	})
 
 	return c.Redirect(http.StatusSeeOther,
 		fmt.Sprintf("/channel/%v", lastID))
 }
 
+// saveAvatar stores the image uploaded as field in the icon directory and
+// returns its file name, or "" when nothing was uploaded.
+func saveAvatar(c echo.Context, field string) (string, error) {
+	fh, err := c.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", nil
+	} else if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	dotPos := strings.LastIndexByte(fh.Filename, '.')
+	if dotPos < 0 {
+		return "", ErrBadReqeust
+	}
+	ext := fh.Filename[dotPos:]
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		break
+	default:
+		return "", ErrBadReqeust
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	avatarData, _ := ioutil.ReadAll(file)
+	file.Close()
+
+	if len(avatarData) == 0 {
+		return "", nil
+	}
+	if len(avatarData) > avatarMaxBytes {
+		return "", ErrBadReqeust
+	}
+
+	avatarName := fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
+	if err := os.WriteFile(fmt.Sprintf("%s/%s", iconPath, avatarName), avatarData, os.ModePerm); err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return avatarName, nil
+}
+
 func postProfile(c echo.Context) error {
 	self, err := ensureLogin(c)
 	if self == nil {
@@ -806,52 +1760,32 @@ func postProfile(c echo.Context) error {
 		return err
 	}
 
-	avatarName := ""
-	var avatarData []byte
-
-	if fh, err := c.FormFile("avatar_icon"); err == http.ErrMissingFile {
-		// no file upload
-	} else if err != nil {
-		log.Println(err)
-		return err
-	} else {
-		dotPos := strings.LastIndexByte(fh.Filename, '.')
-		if dotPos < 0 {
-			return ErrBadReqeust
-		}
-		ext := fh.Filename[dotPos:]
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".gif":
-			break
-		default:
+	// checked first, a wrong password changes nothing
+	if s := c.FormValue("email"); s != "" {
+		email := validEmail(s)
+		if email == "" {
 			return ErrBadReqeust
 		}
-
-		file, err := fh.Open()
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		avatarData, _ = ioutil.ReadAll(file)
-		file.Close()
-
-		if len(avatarData) > avatarMaxBytes {
-			return ErrBadReqeust
+		if self.Email == nil || *self.Email != email {
+			if err := changeEmail(c, self, email); err != nil {
+				if _, ok := err.(*echo.HTTPError); !ok {
+					log.Println(err)
+				}
+				return err
+			}
 		}
-
-		avatarName = fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
 	}
 
-	if avatarName != "" && len(avatarData) > 0 {
+	avatarName, err := saveAvatar(c, "avatar_icon")
+	if err != nil {
+		return err
+	}
+	if avatarName != "" {
 		_, err = db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", avatarName, self.ID)
 		if err != nil {
 			log.Println(err)
 			return err
 		}
-		if err := os.WriteFile(fmt.Sprintf("%s/%s", iconPath, avatarName), avatarData, os.ModePerm); err != nil {
-			log.Println(err)
-			return err
-		}
 	}
 
 	if name := c.FormValue("display_name"); name != "" {
@@ -904,7 +1838,16 @@ func tRange(a, b int64) []int64 {
 	return r
 }
 
+// tEmote returns the action of a "/me" message, "" for other messages.
+func tEmote(content string) string {
+	if strings.HasPrefix(content, "/me ") {
+		return content[len("/me "):]
+	}
+	return ""
+}
+
 func main() {
+	initDB()
 	e := echo.New()
 	e.JSONSerializer = &JSONSerializer{}
 	log.SetFlags(log.Lshortfile)
@@ -919,35 +1862,116 @@ func main() {
 	funcs := template.FuncMap{
 		"add":    tAdd,
 		"xrange": tRange,
+		"emote":  tEmote,
 	}
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secretonymoris"))))
+	if err := initSessionStore(); err != nil {
+		panic("cannot configure sessions: " + err.Error())
+	}
+	if err := initOIDC(); err != nil {
+		panic("cannot configure single sign-on: " + err.Error())
+	}
+	if err := initLoginLimiter(); err != nil {
+		panic("cannot configure login limits: " + err.Error())
+	}
+	if err := initWebhookLimiter(); err != nil {
+		panic("cannot configure webhook rate limits: " + err.Error())
+	}
+	if e.IPExtractor, err = clientIPExtractor(); err != nil {
+		panic("cannot configure trusted proxies: " + err.Error())
+	}
+	if err := initMailer(); err != nil {
+		panic("cannot configure mail: " + err.Error())
+	}
+	e.Use(session.Middleware(newCookieStore()))
 	e.Use(middleware.Static("../public"))
+	e.Use(csrfProtect)
 
 	e.GET("/initialize", getInitialize)
-	e.GET("/initialize/isu3", getInitializeIsu3)
+	e.POST("/peer/event", postPeerEvent)
 	e.GET("/", getIndex)
 	e.GET("/register", getRegister)
 	e.POST("/register", postRegister)
 	e.GET("/login", getLogin)
 	e.POST("/login", postLogin)
+	e.GET("/login/2fa", getLoginTOTP)
+	e.POST("/login/2fa", postLoginTOTP)
+	e.GET("/login/oidc", getOIDCLogin)
+	e.GET("/login/oidc/callback", getOIDCCallback)
+	e.GET("/password/reset", getPasswordReset)
+	e.POST("/password/reset", postPasswordReset)
+	e.GET("/password/reset/:token", getPasswordResetToken)
+	e.GET("/email/confirm/:token", getEmailConfirm)
+	e.POST("/password/reset/:token", postPasswordResetToken)
 	e.GET("/logout", getLogout)
+	e.POST("/logout/all", postLogoutAll)
+	e.POST("/sessions/revoke", postRevokeSession)
+	e.POST("/2fa/enroll", postTOTPEnroll)
+	e.POST("/2fa/confirm", postTOTPConfirm)
+	e.POST("/2fa/disable", postTOTPDisable)
+	e.POST("/admin/users/:user_name/2fa/reset", postAdminResetTOTP)
+	e.POST("/tokens", postAPIToken)
+	e.POST("/tokens/:token_id/revoke", postRevokeAPIToken)
+	e.GET("/subscriptions", getSubscriptions)
+	e.POST("/subscriptions", postSubscription)
+	e.POST("/subscriptions/:subscription_id/delete", postDeleteSubscription)
 
 	e.GET("/channel/:channel_id", getChannel)
 	e.GET("/message", getMessage)
 	e.POST("/message", postMessage)
+	e.POST("/message/schedule", postScheduleMessage)
+	e.PUT("/message/:message_id", putMessage)
+	e.DELETE("/message/:message_id", deleteMessage)
+	e.GET("/message/:message_id/thread", getThread)
+	e.POST("/message/:message_id/reactions", postReaction)
+	e.POST("/message/:message_id/remind", postMessageReminder)
+	e.GET("/scheduled", getScheduled)
+	e.POST("/scheduled/:job_id/cancel", postCancelScheduled)
+	e.DELETE("/message/:message_id/reactions", deleteReaction)
 	e.GET("/fetch", fetchUnread)
+	e.GET("/mentions", getMentions)
+	e.GET("/search", getSearch)
+	e.GET("/stream", getStream)
+	e.GET("/ws", getWebSocket)
 	e.GET("/history/:channel_id", getHistory)
 
 	e.GET("/profile/:user_name", getProfile)
+	e.POST("/dm", postDirectMessage)
+	e.POST("/channel/:channel_id/invite", postChannelInvite)
+	e.POST("/channel/:channel_id/leave", postChannelLeave)
+	e.POST("/channel/:channel_id/edit", postChannelEdit)
+	e.POST("/channel/:channel_id/role", postChannelRole)
+	e.GET("/channel/:channel_id/webhooks", getWebhooks)
+	e.POST("/channel/:channel_id/webhooks", postWebhook)
+	e.POST("/channel/:channel_id/webhooks/:webhook_id/delete", postDeleteWebhook)
+	e.POST("/channel/:channel_id/commands", postCustomCommand)
+	e.POST("/channel/:channel_id/commands/:command_id/delete", postDeleteCustomCommand)
+	e.POST("/hooks/:token", postWebhookMessage)
 	e.POST("/profile", postProfile)
+	e.POST("/profile/password", postPassword)
+	e.POST("/profile/delete", postDeleteAccount)
 
 	e.GET("add_channel", getAddChannel)
 	e.POST("add_channel", postAddChannel)
 	e.GET("/icons/:file_name", getIcon)
 
+	if err := initPasswordHasher(); err != nil {
+		panic("cannot configure password hashing: " + err.Error())
+	}
+	if err := initPeers(); err != nil {
+		panic("cannot configure peers: " + err.Error())
+	}
+	if err := loadChannelCache(); err != nil {
+		panic("cannot load channels: " + err.Error())
+	}
+	if err := initSearch(); err != nil {
+		panic("cannot build search index: " + err.Error())
+	}
+	go newEventDispatcher().Run(context.Background())
+	go newScheduler().Run(context.Background())
+
 	e.Start(":5000")
 }
 
@@ -1026,6 +2050,130 @@ func (c *ChannelCacher) IncrementMessage(key string) {
 	c.Mutex.Unlock()
 }
 
+func (c *ChannelCacher) DecrementMessage(key string) {
+	c.Mutex.Lock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+	cache.Value.MessageCnt--
+	cache.Value.DeletedCnt++
+	c.Mutex.Unlock()
+}
+
+// Reload replaces the whole cache with what load returns. The lock is held
+// while loading, so updates made meanwhile wait and apply to the new
+// contents instead of getting lost with the old ones.
+func (c *ChannelCacher) Reload(load func() ([]*ChannelInfo, []*ChannelMember, error)) error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	channels, members, err := load()
+	if err != nil {
+		return err
+	}
+	cache := make(map[string]struct {
+		Value   *ChannelInfo
+		Expired time.Time
+	}, len(channels))
+	for _, ch := range channels {
+		ch.Members = make(map[int64]string)
+		cache[channelKey(ch.ID)] = struct {
+			Value   *ChannelInfo
+			Expired time.Time
+		}{Value: ch}
+	}
+	for _, m := range members {
+		if ch, ok := cache[channelKey(m.ChannelID)]; ok {
+			ch.Value.Members[m.UserID] = m.Role
+		}
+	}
+	c.Cache = cache
+	return nil
+}
+
+// GetAllFor returns the channels userID may see: public channels and the
+// ones userID is a member of.
+func (c *ChannelCacher) GetAllFor(userID int64) []*ChannelInfo {
+	c.Mutex.RLock()
+	slice := make([]*ChannelInfo, 0, len(c.Cache))
+	for _, v := range c.Cache {
+		if v.Value.Kind == channelKindPublic || v.Value.Members[userID] != "" {
+			slice = append(slice, v.Value)
+		}
+	}
+	c.Mutex.RUnlock()
+	return slice
+}
+
+// MemberRole returns the role of userID in the channel, or "" if userID is
+// not a member.
+func (c *ChannelCacher) MemberRole(key string, userID int64) string {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		return ""
+	}
+	return cache.Value.Members[userID]
+}
+
+// AddMembers adds userIDs to the channel with role, replacing their
+// current role if they are members already.
+func (c *ChannelCacher) AddMembers(key string, role string, userIDs ...int64) {
+	c.Mutex.Lock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+	if cache.Value.Members == nil {
+		cache.Value.Members = make(map[int64]string, len(userIDs))
+	}
+	for _, id := range userIDs {
+		cache.Value.Members[id] = role
+	}
+	c.Mutex.Unlock()
+}
+
+func (c *ChannelCacher) UpdateChannel(key string, name, desc string, updatedAt time.Time) {
+	c.Mutex.Lock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+	cache.Value.Name = name
+	cache.Value.Description = desc
+	cache.Value.UpdatedAt = updatedAt
+	c.Mutex.Unlock()
+}
+
+func (c *ChannelCacher) UpdateDescription(key string, desc string, updatedAt time.Time) {
+	c.Mutex.Lock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+	cache.Value.Description = desc
+	cache.Value.UpdatedAt = updatedAt
+	c.Mutex.Unlock()
+}
+
+func (c *ChannelCacher) RemoveMembers(key string, userIDs ...int64) {
+	c.Mutex.Lock()
+	cache, ok := c.Cacher.Cache[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+	for _, id := range userIDs {
+		delete(cache.Value.Members, id)
+	}
+	c.Mutex.Unlock()
+}
+
 func initCannelCacher() ChannelCacher {
 	return ChannelCacher{
 		Cacher: &Cacher[*ChannelInfo]{
@@ -1038,3 +2186,7 @@ func initCannelCacher() ChannelCacher {
 }
 
 var channelCacher = initCannelCacher()
+
+func channelKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
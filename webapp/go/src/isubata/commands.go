@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/bytedance/sonic/encoder"
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	commandTimeout  = 5 * time.Second
+	commandMaxReply = 4000
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Command is a slash command typed into the chat box.
+type Command struct {
+	User      *User
+	ChannelID int64
+	// ParentID is the thread the command was typed in, 0 for the channel.
+	ParentID int64
+	Name     string
+	Args     string
+}
+
+// A commandFunc runs a command. The returned text is shown to the sender
+// only; errors are for failures the sender can't do anything about.
+type commandFunc func(cmd *Command) (string, error)
+
+var builtinCommands = map[string]commandFunc{
+	"topic":  commandTopic,
+	"invite": commandInvite,
+	"me":     commandMe,
+	"shrug":  commandShrug,
+	"remind": commandRemind,
+}
+
+// CustomCommand forwards its invocations to an HTTP endpoint and posts the
+// reply as its bot user.
+type CustomCommand struct {
+	ID        int64     `db:"id"`
+	ChannelID int64     `db:"channel_id"`
+	UserID    int64     `db:"user_id"`
+	CreatorID int64     `db:"creator_id"`
+	Name      string    `db:"name"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type CommandReply struct {
+	Text      string `json:"text"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+var commandClient = newOutgoingClient()
+
+// parseCommand splits "/name args". A message starting with "//" is not a
+// command; one slash is dropped and the rest posted as is.
+func parseCommand(content string) (name, args string, ok bool) {
+	if !strings.HasPrefix(content, "/") || strings.HasPrefix(content, "//") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(content[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// sendMessage posts content as user, or runs it if it is a command. Commands
+// return the reply shown to the sender only and no message id, their own
+// output is not stored as a message.
+func sendMessage(user *User, chanID, parentID int64, content string) (id int64, reply string, err error) {
+	if name, args, ok := parseCommand(content); ok {
+		reply, err := runCommand(&Command{User: user, ChannelID: chanID, ParentID: parentID, Name: name, Args: args})
+		return 0, reply, err
+	}
+	// an escaped "//text" is posted as "/text"
+	id, err = createMessage(user, chanID, parentID, strings.TrimPrefix(content, "/"))
+	return id, "", err
+}
+
+func runCommand(cmd *Command) (string, error) {
+	if ok, err := authorize(cmd.User.ID, cmd.ChannelID, ActionPost, 0); err != nil {
+		return "", err
+	} else if !ok {
+		return "", echo.ErrForbidden
+	}
+
+	if f, ok := builtinCommands[cmd.Name]; ok {
+		return f(cmd)
+	}
+	var custom CustomCommand
+	err := db.Get(&custom, "SELECT * FROM slash_command WHERE channel_id = ? AND name = ?", cmd.ChannelID, cmd.Name)
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("/%s というコマンドはありません", cmd.Name), nil
+	} else if err != nil {
+		return "", err
+	}
+	return runCustomCommand(cmd, &custom)
+}
+
+func commandTopic(cmd *Command) (string, error) {
+	if cmd.Args == "" {
+		return "使い方: /topic 新しいトピック", nil
+	}
+	if ok, err := authorize(cmd.User.ID, cmd.ChannelID, ActionEditChannel, 0); err != nil {
+		return "", err
+	} else if !ok {
+		return "このチャンネルのトピックを変更する権限がありません", nil
+	}
+	if err := updateChannelDescription(cmd.ChannelID, cmd.Args); err != nil {
+		return "", err
+	}
+	return "トピックを変更しました", nil
+}
+
+func commandInvite(cmd *Command) (string, error) {
+	if cmd.Args == "" {
+		return "使い方: /invite @ユーザ名", nil
+	}
+	if ok, err := authorize(cmd.User.ID, cmd.ChannelID, ActionInvite, 0); err != nil {
+		return "", err
+	} else if !ok {
+		return "このチャンネルには招待できません", nil
+	}
+	for _, name := range strings.Fields(cmd.Args) {
+		if err := inviteMember(cmd.ChannelID, name); err != nil {
+			if herr, ok := err.(*echo.HTTPError); ok {
+				return fmt.Sprint(herr.Message), nil
+			}
+			return "", err
+		}
+	}
+	return cmd.Args + " を招待しました", nil
+}
+
+// commandMe posts an action. The content keeps the "/me " prefix and the
+// clients render it as "<display name> <action>".
+func commandMe(cmd *Command) (string, error) {
+	if cmd.Args == "" {
+		return "使い方: /me 動作", nil
+	}
+	_, err := createMessage(cmd.User, cmd.ChannelID, cmd.ParentID, "/me "+cmd.Args)
+	return "", err
+}
+
+func commandShrug(cmd *Command) (string, error) {
+	content := `¯\_(ツ)_/¯`
+	if cmd.Args != "" {
+		content = cmd.Args + " " + content
+	}
+	_, err := createMessage(cmd.User, cmd.ChannelID, cmd.ParentID, content)
+	return "", err
+}
+
+// commandRemind handles "/remind <duration> <text>", e.g. "/remind 90m
+// deploy". The reminder is posted to the sender's own direct message channel.
+func commandRemind(cmd *Command) (string, error) {
+	s, text, _ := strings.Cut(cmd.Args, " ")
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "使い方: /remind 30m 内容", nil
+	}
+	runAt, err := parseRunAt(s, "")
+	if err != nil {
+		return "使い方: /remind 30m 内容", nil
+	}
+
+	if _, err := scheduleJob(&ScheduledJob{Kind: jobKindReminder, UserID: cmd.User.ID, Content: text, RunAt: runAt}); err != nil {
+		return "", err
+	}
+	return runAt.Format("2006/01/02 15:04") + " にリマインドします", nil
+}
+
+// runCustomCommand posts the invocation to the command's URL, signed like
+// event deliveries, and expects a CommandReply back.
+func runCustomCommand(cmd *Command, custom *CustomCommand) (string, error) {
+	body, err := encoder.Encode(map[string]interface{}{
+		"command":    "/" + cmd.Name,
+		"text":       cmd.Args,
+		"channel_id": cmd.ChannelID,
+		"parent_id":  cmd.ParentID,
+		"user_id":    cmd.User.ID,
+		"user_name":  cmd.User.Name,
+	}, 0)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, custom.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(eventSignatureHeader, signEvent(custom.Secret, time.Now(), body))
+
+	failed := fmt.Sprintf("/%s が応答しませんでした", cmd.Name)
+	res, err := commandClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return failed, nil
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil || res.StatusCode < 200 || res.StatusCode >= 300 {
+		log.Println(res.StatusCode, err)
+		return failed, nil
+	}
+	if len(b) == 0 {
+		return "", nil
+	}
+	var reply CommandReply
+	if err := decoder.NewDecoder(string(b)).Decode(&reply); err != nil {
+		log.Println(err)
+		return failed, nil
+	}
+
+	text := strings.TrimSpace(reply.Text)
+	if len([]rune(text)) > commandMaxReply {
+		text = string([]rune(text)[:commandMaxReply])
+	}
+	if text == "" || reply.Ephemeral {
+		return text, nil
+	}
+	// like webhook bots, command bots post without being channel members
+	_, err = storeMessage(custom.UserID, cmd.ChannelID, cmd.ParentID, text)
+	return "", err
+}
+
+func queryCustomCommands(chanID int64) ([]*CustomCommand, error) {
+	cmds := make([]*CustomCommand, 0)
+	err := db.Select(&cmds, "SELECT * FROM slash_command WHERE channel_id = ? ORDER BY name", chanID)
+	return cmds, err
+}
+
+// postCustomCommand registers a command for the channel. Its signing secret
+// is only shown once.
+func postCustomCommand(c echo.Context) error {
+	self, chanID, err := webhookChannel(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.FormValue("name")), "/"))
+	if !commandNamePattern.MatchString(name) {
+		return ErrBadReqeust
+	}
+	if _, ok := builtinCommands[name]; ok {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("/%s is a built-in command", name))
+	}
+	target := strings.TrimSpace(c.FormValue("url"))
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return ErrBadReqeust
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return err
+	}
+	secret := hex.EncodeToString(b)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	botID, err := createBotUser(tx, "/"+name, "default.png")
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO slash_command (channel_id, user_id, creator_id, name, url, secret, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, NOW())", chanID, botID, self.ID, name, target, secret); err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("/%s already exists", name))
+		}
+		log.Println(err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return renderIntegrations(c, self, chanID, "", secret)
+}
+
+func postDeleteCustomCommand(c echo.Context) error {
+	self, chanID, err := webhookChannel(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	cmdID, err := strconv.ParseInt(c.Param("command_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	res, err := db.Exec("DELETE FROM slash_command WHERE id = ? AND channel_id = ?", cmdID, chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks", chanID))
+}
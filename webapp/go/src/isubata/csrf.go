@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	csrfSessionKey = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+var errCSRF = echo.NewHTTPError(http.StatusForbidden, "invalid csrf token")
+
+// csrfExempt are the routes not authenticated by the session cookie: the
+// webhook token is in the URL and the peers sign their requests.
+var csrfExempt = map[string]bool{
+	"/hooks/:token": true,
+	"/peer/event":   true,
+}
+
+// csrfProtect keeps a token in the session of every visitor and requires it
+// on unsafe requests, either in the csrf_token form field or in the
+// X-CSRF-Token header. The templates get it as CSRFToken.
+func csrfProtect(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// API tokens are sent by scripts, not by the browser on its own
+		if bearerToken(c) != "" || csrfExempt[c.Path()] {
+			return next(c)
+		}
+
+		sess, _ := session.Get("session", c)
+		token, _ := sess.Values[csrfSessionKey].(string)
+		if token == "" {
+			var err error
+			if token, err = randomToken(); err != nil {
+				log.Println(err)
+				return err
+			}
+			sess.Values[csrfSessionKey] = token
+			if err := sess.Save(c.Request(), c.Response()); err != nil {
+				log.Println(err)
+				return err
+			}
+		}
+		c.Set(csrfSessionKey, token)
+
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		sent := c.Request().Header.Get(csrfHeader)
+		if sent == "" {
+			sent = c.FormValue(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(sent)), []byte(token)) != 1 {
+			return errCSRF
+		}
+		return next(c)
+	}
+}
+
+func csrfToken(c echo.Context) string {
+	token, _ := c.Get(csrfSessionKey).(string)
+	return token
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	channelKindPublic  = "public"
+	channelKindPrivate = "private"
+	channelKindDM      = "dm"
+
+	dmMaxMembers = 8
+)
+
+type ChannelMember struct {
+	ChannelID int64  `db:"channel_id"`
+	UserID    int64  `db:"user_id"`
+	Role      string `db:"role"`
+}
+
+// getChannelInfo returns the cached channel and falls back to the DB for
+// channels this node has not heard of yet.
+func getChannelInfo(chanID int64) (*ChannelInfo, error) {
+	if ch, ok := channelCacher.Get(channelKey(chanID)); ok {
+		return ch, nil
+	}
+
+	ch := ChannelInfo{}
+	err := db.Get(&ch, "SELECT * FROM channel WHERE id = ?", chanID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	members := make([]*ChannelMember, 0)
+	if err := db.Select(&members, "SELECT channel_id, user_id, role FROM channel_member WHERE channel_id = ?", chanID); err != nil {
+		return nil, err
+	}
+	channelCacher.Set(channelKey(chanID), &ch, -1)
+	for _, m := range members {
+		channelCacher.AddMembers(channelKey(chanID), m.Role, m.UserID)
+	}
+	return &ch, nil
+}
+
+func dmKey(userIDs []int64) string {
+	ids := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return "dm:" + strings.Join(ids, ",")
+}
+
+// findOrCreateDM returns the direct message channel between exactly
+// userIDs, which must be sorted, creating it on first use.
+func findOrCreateDM(userIDs []int64, names []string) (int64, error) {
+	key := dmKey(userIDs)
+
+	var id int64
+	err := db.Get(&id, "SELECT id FROM channel WHERE dm_key = ?", key)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	name := "@" + strings.Join(names, ", @")
+	desc := "ダイレクトメッセージ"
+	res, err := tx.Exec(
+		"INSERT INTO channel (name, description, kind, dm_key, updated_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		name, desc, channelKindDM, key, now, now)
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+		// created concurrently by another member
+		tx.Rollback()
+		err = db.Get(&id, "SELECT id FROM channel WHERE dm_key = ?", key)
+		return id, err
+	} else if err != nil {
+		return 0, err
+	}
+	id, err = res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, userID := range userIDs {
+		if _, err := tx.Exec("INSERT INTO channel_member (channel_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+			id, userID, roleMember, now); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	channel := &ChannelInfo{ID: id, Name: name, Description: desc, Kind: channelKindDM, DMKey: &key, UpdatedAt: now, CreatedAt: now}
+	channelCacher.Set(channelKey(id), channel, -1)
+	channelCacher.AddMembers(channelKey(id), roleMember, userIDs...)
+	peers.Broadcast(&PeerEvent{Type: peerEventChannelCreated, ChannelID: id, Channel: channel, Members: userIDs, Role: roleMember})
+	return id, nil
+}
+
+func postDirectMessage(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	names := strings.FieldsFunc(c.FormValue("user_names"), func(r rune) bool {
+		return r == ',' || r == '@' || unicode.IsSpace(r)
+	})
+	if len(names) == 0 {
+		return ErrBadReqeust
+	}
+
+	query, args, err := sqlx.In("SELECT id, name FROM user WHERE name IN (?)", names)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	users := make([]*User, 0, len(names))
+	if err := db.Select(&users, query, args...); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	members := map[int64]string{self.ID: self.Name}
+	for _, u := range users {
+		members[u.ID] = u.Name
+	}
+	for _, name := range names {
+		found := false
+		for _, u := range users {
+			found = found || u.Name == name
+		}
+		if !found {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", name))
+		}
+	}
+	if len(members) < 2 || len(members) > dmMaxMembers {
+		return ErrBadReqeust
+	}
+
+	userIDs := make([]int64, 0, len(members))
+	for id := range members {
+		userIDs = append(userIDs, id)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	memberNames := make([]string, 0, len(members))
+	for _, id := range userIDs {
+		memberNames = append(memberNames, members[id])
+	}
+
+	chanID, err := findOrCreateDM(userIDs, memberNames)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chanID))
+}
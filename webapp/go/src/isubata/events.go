@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bytedance/sonic/encoder"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eventMessageCreated = "message.created"
+	eventChannelCreated = "channel.created"
+	eventUserRegistered = "user.registered"
+
+	eventSignatureHeader = "X-Isubata-Signature"
+	eventTypeHeader      = "X-Isubata-Event"
+	eventDeliveryHeader  = "X-Isubata-Delivery"
+
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+
+	subscriptionCacheTTL = 5 * time.Second
+)
+
+var eventTypes = []string{eventMessageCreated, eventChannelCreated, eventUserRegistered}
+
+type EventSubscription struct {
+	ID             int64      `db:"id"`
+	OwnerID        int64      `db:"owner_id"`
+	TargetURL      string     `db:"target_url"`
+	Events         string     `db:"events"`
+	Secret         string     `db:"secret"`
+	LastStatus     *int       `db:"last_status"`
+	LastError      *string    `db:"last_error"`
+	LastDeliveryAt *time.Time `db:"last_delivery_at"`
+	FailureCount   int        `db:"failure_count"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+func (s *EventSubscription) Wants(eventType string) bool {
+	for _, e := range strings.Split(s.Events, ",") {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type OutboxEntry struct {
+	ID             int64      `db:"id"`
+	SubscriptionID int64      `db:"subscription_id"`
+	EventType      string     `db:"event_type"`
+	Payload        string     `db:"payload"`
+	Status         string     `db:"status"`
+	Attempts       int        `db:"attempts"`
+	NextAttemptAt  time.Time  `db:"next_attempt_at"`
+	LastStatus     *int       `db:"last_status"`
+	LastError      *string    `db:"last_error"`
+	DeliveredAt    *time.Time `db:"delivered_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+var subscriptionCacher = &Cacher[[]*EventSubscription]{
+	Cache: make(map[string]struct {
+		Value   []*EventSubscription
+		Expired time.Time
+	}),
+}
+
+func querySubscriptions() ([]*EventSubscription, error) {
+	if subs, ok := subscriptionCacher.Get("all"); ok {
+		return subs, nil
+	}
+	subs := make([]*EventSubscription, 0)
+	if err := db.Select(&subs, "SELECT * FROM event_subscription"); err != nil {
+		return nil, err
+	}
+	subscriptionCacher.Set("all", subs, subscriptionCacheTTL)
+	return subs, nil
+}
+
+// invalidateSubscriptions drops the cached subscriptions on every node.
+func invalidateSubscriptions() {
+	subscriptionCacher.Delete("all")
+	peers.Broadcast(&PeerEvent{Type: peerEventSubscriptionsChanged})
+}
+
+// emitEvent queues an event for every subscription that wants it and whose
+// owner may see it: chanID is the channel the event belongs to, 0 if none.
+// Delivery happens later from the outbox. Errors are only logged so that an
+// unreachable outbox never fails the action that caused the event.
+func emitEvent(eventType string, chanID int64, data interface{}) {
+	subs, err := querySubscriptions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var payload []byte
+	for _, s := range subs {
+		if !s.Wants(eventType) {
+			continue
+		}
+		if chanID != 0 {
+			if ok, err := authorize(s.OwnerID, chanID, ActionRead, 0); err != nil || !ok {
+				continue
+			}
+		}
+		if payload == nil {
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				log.Println(err)
+				return
+			}
+			if payload, err = encoder.Encode(map[string]interface{}{
+				"id":         hex.EncodeToString(id),
+				"type":       eventType,
+				"created_at": time.Now().Unix(),
+				"data":       data,
+			}, 0); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if _, err := db.Exec("INSERT INTO event_outbox (subscription_id, event_type, payload, status, attempts, next_attempt_at, created_at)"+
+			" VALUES (?, ?, ?, ?, 0, NOW(), NOW())", s.ID, eventType, string(payload), outboxPending); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func messageEventData(m *Message) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         m.ID,
+		"channel_id": m.ChannelID,
+		"user_id":    m.UserID,
+		"content":    m.Content,
+		"parent_id":  m.ParentID,
+		"created_at": m.CreatedAt.Unix(),
+	}
+}
+
+// signEvent returns the signature header of body: the unix time it was
+// signed at and the hex HMAC-SHA256 of "<time>.<body>" keyed with secret.
+func signEvent(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// EventDispatcher delivers the outbox. Every node may run one: an entry is
+// claimed by pushing its next_attempt_at forward before it is sent.
+type EventDispatcher struct {
+	Client      *http.Client
+	Interval    time.Duration
+	BatchSize   int
+	MaxAttempts int
+	// the n-th retry waits BaseBackoff * 2^(n-1), at most MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// delivered and failed entries are deleted after Retention
+	Retention time.Duration
+}
+
+var errPrivateAddress = errors.New("refusing to deliver to a private address")
+
+// publicOnlyControl makes a dialer refuse loopback, private and link-local
+// addresses, so subscriptions cannot probe the internal network.
+func publicOnlyControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// newOutgoingClient returns the client for requests to user supplied URLs.
+// ISUBATA_EVENTS_ALLOW_PRIVATE=1 allows targets in private networks.
+func newOutgoingClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if os.Getenv("ISUBATA_EVENTS_ALLOW_PRIVATE") != "1" {
+		dialer.Control = publicOnlyControl
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		// a redirect could lead anywhere, report it as a failure instead
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func newEventDispatcher() *EventDispatcher {
+	return &EventDispatcher{
+		Client:      newOutgoingClient(),
+		Interval:    time.Second,
+		BatchSize:   50,
+		MaxAttempts: 8,
+		BaseBackoff: 10 * time.Second,
+		MaxBackoff:  time.Hour,
+		Retention:   7 * 24 * time.Hour,
+	}
+}
+
+func (d *EventDispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+	var lastPurge time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := d.DeliverDue(ctx); err != nil {
+				log.Println(err)
+			}
+			if time.Since(lastPurge) > time.Minute {
+				if err := d.Purge(); err != nil {
+					log.Println(err)
+				}
+				lastPurge = time.Now()
+			}
+		}
+	}
+}
+
+// Purge deletes the finished entries older than the retention, in batches
+// so that the table isn't locked for long.
+func (d *EventDispatcher) Purge() error {
+	_, err := db.Exec("DELETE FROM event_outbox WHERE status <> ? AND created_at < ? LIMIT 1000",
+		outboxPending, time.Now().Add(-d.Retention))
+	return err
+}
+
+func (d *EventDispatcher) backoff(attempts int) time.Duration {
+	wait := d.BaseBackoff
+	for i := 1; i < attempts && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
+
+// DeliverDue sends the entries whose next attempt is due.
+func (d *EventDispatcher) DeliverDue(ctx context.Context) error {
+	entries := make([]*OutboxEntry, 0, d.BatchSize)
+	if err := db.Select(&entries, "SELECT * FROM event_outbox WHERE status = ? AND next_attempt_at <= NOW() ORDER BY id LIMIT ?",
+		outboxPending, d.BatchSize); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// the lease outlives the request, so no other node picks it up meanwhile
+		lease := time.Now().Add(2 * d.Client.Timeout)
+		res, err := db.Exec("UPDATE event_outbox SET next_attempt_at = ? WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at <= NOW()",
+			lease, e.ID, outboxPending, e.Attempts)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := d.deliver(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *EventDispatcher) deliver(ctx context.Context, e *OutboxEntry) error {
+	var sub EventSubscription
+	err := db.Get(&sub, "SELECT * FROM event_subscription WHERE id = ?", e.SubscriptionID)
+	if err == sql.ErrNoRows {
+		// deleted while the entry was queued
+		_, err = db.Exec("DELETE FROM event_outbox WHERE id = ?", e.ID)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	status, sendErr := d.send(ctx, &sub, e)
+	now := time.Now()
+	e.Attempts++
+	var lastErr *string
+	if sendErr != nil {
+		msg := sendErr.Error()
+		lastErr = &msg
+	}
+	var lastStatus *int
+	if status != 0 {
+		lastStatus = &status
+	}
+
+	if sendErr == nil {
+		_, err = db.Exec("UPDATE event_outbox SET status = ?, attempts = ?, last_status = ?, last_error = NULL, delivered_at = ? WHERE id = ?",
+			outboxDelivered, e.Attempts, lastStatus, now, e.ID)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("UPDATE event_subscription SET last_status = ?, last_error = NULL, last_delivery_at = ? WHERE id = ?",
+			lastStatus, now, sub.ID)
+		return err
+	}
+
+	next, state := now.Add(d.backoff(e.Attempts)), outboxPending
+	if e.Attempts >= d.MaxAttempts {
+		state = outboxFailed
+	}
+	if _, err := db.Exec("UPDATE event_outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_status = ?, last_error = ? WHERE id = ?",
+		state, e.Attempts, next, lastStatus, lastErr, e.ID); err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE event_subscription SET last_status = ?, last_error = ?, last_delivery_at = ?, failure_count = failure_count + 1 WHERE id = ?",
+		lastStatus, lastErr, now, sub.ID)
+	return err
+}
+
+// send posts the entry and returns the response status. Anything but 2xx
+// is an error.
+func (d *EventDispatcher) send(ctx context.Context, sub *EventSubscription, e *OutboxEntry) (int, error) {
+	body := []byte(e.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.TargetURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(eventTypeHeader, e.EventType)
+	req.Header.Set(eventDeliveryHeader, strconv.FormatInt(e.ID, 10))
+	req.Header.Set(eventSignatureHeader, signEvent(sub.Secret, time.Now(), body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func renderSubscriptions(c echo.Context, self *User, newSecret string) error {
+	subs := make([]*EventSubscription, 0)
+	if err := db.Select(&subs, "SELECT * FROM event_subscription WHERE owner_id = ? ORDER BY id", self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	deliveries := make([]*OutboxEntry, 0)
+	if err := db.Select(&deliveries, "SELECT o.* FROM event_outbox o JOIN event_subscription s ON o.subscription_id = s.id"+
+		" WHERE s.owner_id = ? ORDER BY o.id DESC LIMIT 50", self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return c.Render(http.StatusOK, "subscriptions", map[string]interface{}{
+		"ChannelID":     0,
+		"Channels":      channels,
+		"User":          self,
+		"Subscriptions": subs,
+		"Deliveries":    deliveries,
+		"EventTypes":    eventTypes,
+		"NewSecret":     newSecret,
+	})
+}
+
+func getSubscriptions(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	return renderSubscriptions(c, self, "")
+}
+
+// postSubscription registers a target URL for some event types. The signing
+// secret is generated here and shown once.
+func postSubscription(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	target, err := url.Parse(strings.TrimSpace(c.FormValue("target_url")))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "target_url must be an http(s) URL")
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return ErrBadReqeust
+	}
+	events := make([]string, 0, len(eventTypes))
+	for _, e := range form["events"] {
+		known := e == "*"
+		for _, t := range eventTypes {
+			known = known || e == t
+		}
+		if !known {
+			return ErrBadReqeust
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		return ErrBadReqeust
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return err
+	}
+	secret := hex.EncodeToString(b)
+	if _, err := db.Exec("INSERT INTO event_subscription (owner_id, target_url, events, secret, created_at) VALUES (?, ?, ?, ?, NOW())",
+		self.ID, target.String(), strings.Join(events, ","), secret); err != nil {
+		log.Println(err)
+		return err
+	}
+	invalidateSubscriptions()
+
+	return renderSubscriptions(c, self, secret)
+}
+
+func postDeleteSubscription(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	subID, err := strconv.ParseInt(c.Param("subscription_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	res, err := db.Exec("DELETE FROM event_subscription WHERE id = ? AND owner_id = ?", subID, self.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	if _, err := db.Exec("DELETE FROM event_outbox WHERE subscription_id = ?", subID); err != nil {
+		log.Println(err)
+		return err
+	}
+	invalidateSubscriptions()
+	return c.Redirect(http.StatusSeeOther, "/subscriptions")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignEvent(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"message.created"}`)
+	got := signEvent("secret", at, body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got != want {
+		t.Fatalf("signEvent = %q, want %q", got, want)
+	}
+	if signEvent("other", at, body) == got {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestEventDispatcherBackoff(t *testing.T) {
+	d := &EventDispatcher{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute}
+	for attempts, want := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: time.Minute,
+		9: time.Minute,
+	} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestEventDispatcherSend(t *testing.T) {
+	t.Setenv("ISUBATA_EVENTS_ALLOW_PRIVATE", "1")
+
+	status := http.StatusOK
+	var header http.Header
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		header, body = r.Header, string(b)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	d := newEventDispatcher()
+	sub := &EventSubscription{ID: 1, TargetURL: srv.URL, Secret: "secret"}
+	e := &OutboxEntry{ID: 42, EventType: eventMessageCreated, Payload: `{"id":1}`}
+
+	if _, err := d.send(context.Background(), sub, e); err != nil {
+		t.Fatal(err)
+	}
+	if body != e.Payload || header.Get(eventTypeHeader) != eventMessageCreated || header.Get(eventDeliveryHeader) != "42" {
+		t.Fatalf("unexpected delivery: %v %q", header, body)
+	}
+	ts, _, _ := strings.Cut(strings.TrimPrefix(header.Get(eventSignatureHeader), "t="), ",")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		t.Fatalf("bad signature header %q", header.Get(eventSignatureHeader))
+	}
+	if want := signEvent("secret", time.Unix(sec, 0), []byte(e.Payload)); header.Get(eventSignatureHeader) != want {
+		t.Fatalf("signature %q, want %q", header.Get(eventSignatureHeader), want)
+	}
+
+	// a failed delivery is an error, which the dispatcher retries
+	status = http.StatusInternalServerError
+	if got, err := d.send(context.Background(), sub, e); err == nil || got != http.StatusInternalServerError {
+		t.Fatalf("send = %d, %v, want an error for status 500", got, err)
+	}
+}
+
+func TestOutgoingClientRejectsPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	t.Setenv("ISUBATA_EVENTS_ALLOW_PRIVATE", "")
+	if _, err := newOutgoingClient().Get(srv.URL); !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("request to %s: err = %v, want %v", srv.URL, err, errPrivateAddress)
+	}
+
+	t.Setenv("ISUBATA_EVENTS_ALLOW_PRIVATE", "1")
+	res, err := newOutgoingClient().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
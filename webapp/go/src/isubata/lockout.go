@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic/encoder"
+	"github.com/labstack/echo/v4"
+)
+
+// LockoutPolicy locks a key out once it has Threshold failures within
+// Window. The lockout starts at BaseDelay and doubles with every further
+// failure up to MaxDelay.
+type LockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p *LockoutPolicy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+type AttemptState struct {
+	Key            string     `db:"attempt_key"`
+	Failures       int        `db:"failures"`
+	FirstFailureAt time.Time  `db:"first_failure_at"`
+	LockedUntil    *time.Time `db:"locked_until"`
+}
+
+// Locked returns how long the key stays locked out, 0 if it isn't.
+func (s *AttemptState) Locked(now time.Time) time.Duration {
+	if s == nil || s.LockedUntil == nil || !now.Before(*s.LockedUntil) {
+		return 0
+	}
+	return s.LockedUntil.Sub(now)
+}
+
+// record counts a failure in s, a nil s being a key without failures.
+func (p *LockoutPolicy) record(key string, s *AttemptState, now time.Time) *AttemptState {
+	if s == nil || now.Sub(s.FirstFailureAt) > p.Window {
+		s = &AttemptState{Key: key, FirstFailureAt: now}
+	}
+	s.Failures++
+	if d := p.delay(s.Failures); d > 0 {
+		until := now.Add(d)
+		s.LockedUntil = &until
+	}
+	return s
+}
+
+// AttemptStore keeps the failure counts. The nodes have to share it for the
+// limits to hold across them.
+type AttemptStore interface {
+	Get(key string) (*AttemptState, error)
+	// Fail records a failure of key under policy and returns the new state.
+	Fail(key string, policy *LockoutPolicy) (*AttemptState, error)
+	Reset(key string) error
+}
+
+type memoryAttemptStore struct {
+	sync.Mutex
+	states map[string]*AttemptState
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	s := &memoryAttemptStore{states: make(map[string]*AttemptState)}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.expire()
+		}
+	}()
+	return s
+}
+
+func (m *memoryAttemptStore) expire() {
+	now := time.Now()
+	m.Lock()
+	for key, s := range m.states {
+		if s.Locked(now) == 0 && now.Sub(s.FirstFailureAt) > 24*time.Hour {
+			delete(m.states, key)
+		}
+	}
+	m.Unlock()
+}
+
+func (m *memoryAttemptStore) Get(key string) (*AttemptState, error) {
+	m.Lock()
+	defer m.Unlock()
+	if s, ok := m.states[key]; ok {
+		copied := *s
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryAttemptStore) Fail(key string, policy *LockoutPolicy) (*AttemptState, error) {
+	m.Lock()
+	defer m.Unlock()
+	s := policy.record(key, m.states[key], time.Now())
+	m.states[key] = s
+	copied := *s
+	return &copied, nil
+}
+
+func (m *memoryAttemptStore) Reset(key string) error {
+	m.Lock()
+	delete(m.states, key)
+	m.Unlock()
+	return nil
+}
+
+type mysqlAttemptStore struct{}
+
+func (*mysqlAttemptStore) Get(key string) (*AttemptState, error) {
+	s := AttemptState{}
+	err := db.Get(&s, "SELECT * FROM login_attempt WHERE attempt_key = ?", key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (*mysqlAttemptStore) Fail(key string, policy *LockoutPolicy) (*AttemptState, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the row lock serializes failures of the same key from both nodes
+	var s *AttemptState
+	current := AttemptState{}
+	err = tx.Get(&current, "SELECT * FROM login_attempt WHERE attempt_key = ? FOR UPDATE", key)
+	if err == nil {
+		s = &current
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	s = policy.record(key, s, time.Now())
+	if _, err := tx.Exec("INSERT INTO login_attempt (attempt_key, failures, first_failure_at, locked_until) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE failures = VALUES(failures), first_failure_at = VALUES(first_failure_at), locked_until = VALUES(locked_until)",
+		s.Key, s.Failures, s.FirstFailureAt, s.LockedUntil); err != nil {
+		return nil, err
+	}
+	return s, tx.Commit()
+}
+
+func (*mysqlAttemptStore) Reset(key string) error {
+	_, err := db.Exec("DELETE FROM login_attempt WHERE attempt_key = ?", key)
+	return err
+}
+
+var (
+	attemptStore AttemptStore
+
+	// policies per kind of key: one IP may be shared by many people, so it
+	// gets more room than a single account name
+	loginIPPolicy    = &LockoutPolicy{Threshold: 20, Window: 15 * time.Minute, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	loginNamePolicy  = &LockoutPolicy{Threshold: 5, Window: 15 * time.Minute, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	registerIPPolicy = &LockoutPolicy{Threshold: 10, Window: time.Hour, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	resetIPPolicy    = &LockoutPolicy{Threshold: 5, Window: time.Hour, BaseDelay: time.Minute, MaxDelay: time.Hour}
+
+	auditLogger = log.New(os.Stderr, "", 0)
+)
+
+// clientIPExtractor takes the client address from the X-Real-IP header
+// nginx sets, but only on requests from loopback or from the comma
+// separated ranges in ISUBATA_TRUSTED_PROXIES, e.g. "172.31.0.0/16" when
+// nginx runs on another host. Anybody else could pick the address the
+// lockouts are keyed by. The shipped isubata.env sets the range for the
+// nginx on s1; a proxy left out is reported once in the log, since all its
+// clients then share its address.
+func clientIPExtractor() (echo.IPExtractor, error) {
+	options := []echo.TrustOption{echo.TrustLoopback(true), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, s := range strings.Split(os.Getenv("ISUBATA_TRUSTED_PROXIES"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", s)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	extract, direct := echo.ExtractIPFromRealIPHeader(options...), echo.ExtractIPDirect()
+	var warned sync.Once
+	return func(req *http.Request) string {
+		ip := extract(req)
+		if header := req.Header.Get(echo.HeaderXRealIP); header != "" && header != ip && ip == direct(req) {
+			warned.Do(func() {
+				log.Printf("ignoring X-Real-IP from untrusted proxy %s, add it to ISUBATA_TRUSTED_PROXIES", ip)
+			})
+		}
+		return ip
+	}, nil
+}
+
+// initLoginLimiter configures the brute-force protection:
+// ISUBATA_LOCKOUT_STORE is "memory" (default) or "mysql", which the nodes
+// share. ISUBATA_LOCKOUT_IP_THRESHOLD, ISUBATA_LOCKOUT_NAME_THRESHOLD,
+// ISUBATA_REGISTER_IP_THRESHOLD and ISUBATA_RESET_IP_THRESHOLD set the
+// failures before a lockout,
+// ISUBATA_LOCKOUT_BASE_DELAY and ISUBATA_LOCKOUT_MAX_DELAY its length.
+// Audit events are written to ISUBATA_AUDIT_LOG, or the main log.
+func initLoginLimiter() error {
+	switch os.Getenv("ISUBATA_LOCKOUT_STORE") {
+	case "", "memory":
+		attemptStore = newMemoryAttemptStore()
+	case "mysql":
+		attemptStore = &mysqlAttemptStore{}
+	default:
+		return fmt.Errorf("unknown lockout store %q", os.Getenv("ISUBATA_LOCKOUT_STORE"))
+	}
+
+	for env, p := range map[string]*LockoutPolicy{
+		"ISUBATA_LOCKOUT_IP_THRESHOLD":   loginIPPolicy,
+		"ISUBATA_LOCKOUT_NAME_THRESHOLD": loginNamePolicy,
+		"ISUBATA_REGISTER_IP_THRESHOLD":  registerIPPolicy,
+		"ISUBATA_RESET_IP_THRESHOLD":     resetIPPolicy,
+	} {
+		if s := os.Getenv(env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s %q", env, s)
+			}
+			p.Threshold = n
+		}
+	}
+	for env, set := range map[string]func(time.Duration){
+		"ISUBATA_LOCKOUT_BASE_DELAY": func(d time.Duration) {
+			loginIPPolicy.BaseDelay, loginNamePolicy.BaseDelay, registerIPPolicy.BaseDelay, resetIPPolicy.BaseDelay = d, d, d, d
+		},
+		"ISUBATA_LOCKOUT_MAX_DELAY": func(d time.Duration) {
+			loginIPPolicy.MaxDelay, loginNamePolicy.MaxDelay, registerIPPolicy.MaxDelay, resetIPPolicy.MaxDelay = d, d, d, d
+		},
+	} {
+		if s := os.Getenv(env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s %q", env, s)
+			}
+			set(d)
+		}
+	}
+
+	var w io.Writer = log.Writer()
+	if path := os.Getenv("ISUBATA_AUDIT_LOG"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	auditLogger = log.New(w, "", 0)
+	return nil
+}
+
+// audit writes a security event as a JSON line.
+func audit(c echo.Context, event string, fields map[string]interface{}) {
+	entry := map[string]interface{}{
+		"time":       time.Now().Format(time.RFC3339),
+		"event":      event,
+		"ip":         c.RealIP(),
+		"user_agent": c.Request().UserAgent(),
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	b, err := encoder.Encode(entry, encoder.SortMapKeys)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	auditLogger.Println(string(b))
+}
+
+// checkLockout refuses the request while any of keys is locked out.
+func checkLockout(c echo.Context, event string, keys ...string) error {
+	now := time.Now()
+	for _, key := range keys {
+		s, err := attemptStore.Get(key)
+		if err != nil {
+			return err
+		}
+		if wait := s.Locked(now); wait > 0 {
+			audit(c, event, map[string]interface{}{"key": key, "retry_after": int(wait.Seconds()) + 1})
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many attempts, try again later")
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failure against every key with its policy.
+func recordFailure(policies map[string]*LockoutPolicy) {
+	for key, p := range policies {
+		if _, err := attemptStore.Fail(key, p); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends a plain text mail.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// logMailer writes the mails to the log instead of sending them.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// fileMailer appends the mails to a file, in mbox format so that a mail
+// client can open it.
+type fileMailer struct {
+	sync.Mutex
+	path string
+	from string
+}
+
+func (m *fileMailer) Send(to, subject, body string) error {
+	m.Lock()
+	defer m.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "From %s %s\n%s\n", m.from, time.Now().Format(time.ANSIC), mailMessage(m.from, to, subject, body)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(mailMessage(m.from, to, subject, body)))
+}
+
+func mailMessage(from, to, subject, body string) string {
+	return strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		// headers are ASCII only, the subject is encoded as RFC 2047 words
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+		"",
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	}, "\r\n")
+}
+
+var mailer Mailer = logMailer{}
+
+// initMailer configures the mail sender from ISUBATA_MAIL_SENDER: "log"
+// (default) only logs the mails, "file" appends them to ISUBATA_MAIL_FILE
+// and "smtp" sends them through ISUBATA_SMTP_ADDR, authenticating with
+// ISUBATA_SMTP_USER and ISUBATA_SMTP_PASSWORD when set. ISUBATA_MAIL_FROM is
+// the sender address.
+func initMailer() error {
+	from := os.Getenv("ISUBATA_MAIL_FROM")
+	if from == "" {
+		from = "isubata@localhost"
+	}
+
+	switch os.Getenv("ISUBATA_MAIL_SENDER") {
+	case "", "log":
+		mailer = logMailer{}
+	case "file":
+		path := os.Getenv("ISUBATA_MAIL_FILE")
+		if path == "" {
+			return fmt.Errorf("ISUBATA_MAIL_FILE is required for the file mail sender")
+		}
+		mailer = &fileMailer{path: path, from: from}
+	case "smtp":
+		addr := os.Getenv("ISUBATA_SMTP_ADDR")
+		host, _, ok := strings.Cut(addr, ":")
+		if !ok {
+			return fmt.Errorf("invalid smtp address %q", addr)
+		}
+		var auth smtp.Auth
+		if user := os.Getenv("ISUBATA_SMTP_USER"); user != "" {
+			auth = smtp.PlainAuth("", user, os.Getenv("ISUBATA_SMTP_PASSWORD"), host)
+		}
+		mailer = &smtpMailer{addr: addr, auth: auth, from: from}
+	default:
+		return fmt.Errorf("unknown mail sender %q", os.Getenv("ISUBATA_MAIL_SENDER"))
+	}
+	return nil
+}
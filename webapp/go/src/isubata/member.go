@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type MemberInfo struct {
+	User
+	Role string `db:"role"`
+}
+
+func queryChannelMembers(chanID int64) ([]*MemberInfo, error) {
+	users := make([]*MemberInfo, 0)
+	err := db.Select(&users, "SELECT u.id, u.name, u.display_name, u.avatar_icon, cm.role FROM channel_member cm"+
+		" JOIN user u ON cm.user_id = u.id WHERE cm.channel_id = ? ORDER BY cm.created_at", chanID)
+	return users, err
+}
+
+// postChannelInvite adds a user to a private channel. Any member may invite.
+func postChannelInvite(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if ok, err := authorize(self.ID, chanID, ActionInvite, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	if err := inviteMember(chanID, c.FormValue("user_name")); err != nil {
+		if _, ok := err.(*echo.HTTPError); !ok {
+			log.Println(err)
+		}
+		return err
+	}
+
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chanID))
+}
+
+// inviteMember adds the user called name, with or without a leading @, to
+// the channel. It is a no-op for members.
+func inviteMember(chanID int64, name string) error {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+	var invitee User
+	err := db.Get(&invitee, "SELECT id, name FROM user WHERE name = ?", name)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", name))
+	} else if err != nil {
+		return err
+	}
+
+	if channelCacher.MemberRole(channelKey(chanID), invitee.ID) != "" {
+		return nil
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO channel_member (channel_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		chanID, invitee.ID, roleMember, time.Now()); err != nil {
+		return err
+	}
+	channelCacher.AddMembers(channelKey(chanID), roleMember, invitee.ID)
+	peers.Broadcast(&PeerEvent{Type: peerEventMembersAdded, ChannelID: chanID, Members: []int64{invitee.ID}, Role: roleMember})
+	return nil
+}
+
+func postChannelLeave(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	// a direct message is defined by its members, so nobody can leave it
+	if ok, err := authorize(self.ID, chanID, ActionLeave, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	if _, err := db.Exec("DELETE FROM channel_member WHERE channel_id = ? AND user_id = ?", chanID, self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM haveread WHERE channel_id = ? AND user_id = ?", chanID, self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	channelCacher.RemoveMembers(channelKey(chanID), self.ID)
+	broadcaster.Publish(&StreamEvent{Type: streamEventMembersRemoved, ChannelID: chanID, Members: []int64{self.ID}})
+	peers.Broadcast(&PeerEvent{Type: peerEventMembersRemoved, ChannelID: chanID, Members: []int64{self.ID}})
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// postChannelEdit renames a channel and updates its description.
+func postChannelEdit(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if ok, err := authorize(self.ID, chanID, ActionEditChannel, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	desc := c.FormValue("description")
+	if name == "" || desc == "" {
+		return ErrBadReqeust
+	}
+	if err := updateChannelInfo(chanID, name, desc); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chanID))
+}
+
+func updateChannelInfo(chanID int64, name, desc string) error {
+	now := time.Now()
+	if _, err := db.Exec("UPDATE channel SET name = ?, description = ?, updated_at = ? WHERE id = ?",
+		name, desc, now, chanID); err != nil {
+		return err
+	}
+	channelCacher.UpdateChannel(channelKey(chanID), name, desc, now)
+	peers.Broadcast(&PeerEvent{Type: peerEventChannelUpdated, ChannelID: chanID,
+		Channel: &ChannelInfo{ID: chanID, Name: name, Description: desc, UpdatedAt: now}})
+	return nil
+}
+
+// updateChannelDescription changes only the description, so that a rename
+// made meanwhile is not undone.
+func updateChannelDescription(chanID int64, desc string) error {
+	now := time.Now()
+	if _, err := db.Exec("UPDATE channel SET description = ?, updated_at = ? WHERE id = ?", desc, now, chanID); err != nil {
+		return err
+	}
+	channelCacher.UpdateDescription(channelKey(chanID), desc, now)
+	peers.Broadcast(&PeerEvent{Type: peerEventTopicUpdated, ChannelID: chanID,
+		Channel: &ChannelInfo{ID: chanID, Description: desc, UpdatedAt: now}})
+	return nil
+}
+
+// postChannelRole promotes a member to moderator or demotes them back.
+// Only the owner may do this and ownership itself cannot be handed over.
+func postChannelRole(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	role := c.FormValue("role")
+	if role != roleModerator && role != roleMember {
+		return ErrBadReqeust
+	}
+	if ok, err := authorize(self.ID, chanID, ActionSetRole, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	name := strings.TrimPrefix(strings.TrimSpace(c.FormValue("user_name")), "@")
+	var target User
+	err = db.Get(&target, "SELECT id, name FROM user WHERE name = ?", name)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", name))
+	} else if err != nil {
+		log.Println(err)
+		return err
+	}
+	current := channelCacher.MemberRole(channelKey(chanID), target.ID)
+	if current == roleOwner {
+		return ErrBadReqeust
+	}
+	ch, err := getChannelInfo(chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	// only members of a private channel can be given a role there
+	if ch.Kind == channelKindPrivate && current == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("user %s is not a member", name))
+	}
+
+	if _, err := db.Exec("INSERT INTO channel_member (channel_id, user_id, role, created_at) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE role = VALUES(role)", chanID, target.ID, role, time.Now()); err != nil {
+		log.Println(err)
+		return err
+	}
+	channelCacher.AddMembers(channelKey(chanID), role, target.ID)
+	peers.Broadcast(&PeerEvent{Type: peerEventMembersAdded, ChannelID: chanID, Members: []int64{target.ID}, Role: role})
+
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", chanID))
+}
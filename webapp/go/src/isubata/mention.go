@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const mentionsPerPage = 50
+
+// the name can't end in "." or "-", so that "thanks @alice." mentions alice
+var mentionPattern = regexp.MustCompile(`@([0-9A-Za-z_\-.]*[0-9A-Za-z_])`)
+
+// parseMentions returns the distinct user names mentioned in content.
+func parseMentions(content string) []string {
+	seen := map[string]bool{}
+	names := make([]string, 0)
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+func mentions(content, name string) bool {
+	for _, n := range parseMentions(content) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addMentions stores a mention row for every user named in content who can
+// read the channel. Mentioning yourself is ignored.
+func addMentions(chanID, msgID int64, parentID *int64, authorID int64, content string) error {
+	names := parseMentions(content)
+	if len(names) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT id FROM user WHERE name IN (?)", names)
+	if err != nil {
+		return err
+	}
+	userIDs := make([]int64, 0, len(names))
+	if err := db.Select(&userIDs, query, args...); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		if userID == authorID {
+			continue
+		}
+		if ok, err := authorize(userID, chanID, ActionRead, 0); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if _, err := db.Exec("INSERT IGNORE INTO mention (user_id, message_id, channel_id, parent_id, created_at) VALUES (?, ?, ?, ?, ?)",
+			userID, msgID, chanID, parentID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryMentionCounts returns the number of unread mentions per channel.
+func queryMentionCounts(userID int64) (map[int64]int64, error) {
+	rows := []struct {
+		ChannelID int64 `db:"channel_id"`
+		Cnt       int64 `db:"cnt"`
+	}{}
+	err := db.Select(&rows, "SELECT mn.channel_id, COUNT(*) AS cnt FROM mention mn JOIN message m ON m.id = mn.message_id"+
+		" WHERE mn.user_id = ? AND mn.read_at IS NULL AND m.deleted_at IS NULL GROUP BY mn.channel_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(rows))
+	for _, r := range rows {
+		counts[r.ChannelID] = r.Cnt
+	}
+	return counts, nil
+}
+
+type Mention struct {
+	Message
+	ReadAt *time.Time `db:"read_at"`
+}
+
+// getMentions lists the messages mentioning the current user, newest
+// first. Older pages are fetched with before_id.
+func getMentions(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	beforeID := int64(1<<63 - 1)
+	if s := c.QueryParam("before_id"); s != "" {
+		var err error
+		if beforeID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	rows := make([]*Mention, 0)
+	err := db.Select(&rows, "SELECT m.*, mn.read_at, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot`"+
+		" FROM mention mn JOIN message m ON m.id = mn.message_id JOIN user u ON m.user_id = u.id"+
+		" WHERE mn.user_id = ? AND mn.message_id < ? AND m.deleted_at IS NULL ORDER BY mn.message_id DESC LIMIT ?",
+		userID, beforeID, mentionsPerPage)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	response := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		// access may have been lost since, e.g. by leaving a private channel
+		if ok, err := authorize(userID, r.ChannelID, ActionRead, 0); err != nil {
+			log.Println(err)
+			return err
+		} else if !ok {
+			continue
+		}
+		j := messageJSON(&r.Message)
+		j["channel_id"] = r.ChannelID
+		j["read"] = r.ReadAt != nil
+		response = append(response, j)
+	}
+	return c.JSON(http.StatusOK, response)
+}
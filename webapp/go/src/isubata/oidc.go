@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	oidcDiscoveryTTL = time.Hour
+	// an unknown kid refetches the key set at most this often
+	oidcJWKSRefresh = time.Minute
+	oidcClockSkew   = time.Minute
+)
+
+var (
+	// oidcProvider is nil unless single sign-on is configured.
+	oidcProvider *OIDCProvider
+	// passwordLogin is false when users may only log in through the provider.
+	passwordLogin = true
+
+	errInvalidIDToken = errors.New("invalid id token")
+
+	userNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// OIDCProvider logs users in with the authorization code flow and PKCE.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is derived from the request when empty.
+	RedirectURL string
+	Client      *http.Client
+
+	mutex     sync.Mutex
+	discovery *oidcDiscovery
+	fetchedAt time.Time
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type IDTokenClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	AuthorizedParty   string      `json:"azp"`
+	Expiry            int64       `json:"exp"`
+	IssuedAt          int64       `json:"iat"`
+	Nonce             string      `json:"nonce"`
+	PreferredUsername string      `json:"preferred_username"`
+	Name              string      `json:"name"`
+	Email             string      `json:"email"`
+}
+
+// initOIDC enables single sign-on when ISUBATA_OIDC_ISSUER and
+// ISUBATA_OIDC_CLIENT_ID are set. ISUBATA_PASSWORD_LOGIN=0 turns password
+// login and registration off.
+func initOIDC() error {
+	if issuer := os.Getenv("ISUBATA_OIDC_ISSUER"); issuer != "" {
+		clientID := os.Getenv("ISUBATA_OIDC_CLIENT_ID")
+		if clientID == "" {
+			return errors.New("ISUBATA_OIDC_CLIENT_ID is required with ISUBATA_OIDC_ISSUER")
+		}
+		oidcProvider = &OIDCProvider{
+			Issuer:       strings.TrimSuffix(issuer, "/"),
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("ISUBATA_OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("ISUBATA_OIDC_REDIRECT_URL"),
+			Client:       &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	passwordLogin = os.Getenv("ISUBATA_PASSWORD_LOGIN") != "0"
+	if !passwordLogin && oidcProvider == nil {
+		return errors.New("password login is disabled but no OIDC provider is configured")
+	}
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", u, res.StatusCode)
+	}
+	return decoder.NewDecoder(string(b)).Decode(v)
+}
+
+// Discovery returns the provider's metadata, cached for oidcDiscoveryTTL.
+func (p *OIDCProvider) Discovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil && time.Since(p.fetchedAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.discovery, p.fetchedAt = &d, time.Now()
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mutex.Lock()
+	k, ok := p.keys[kid]
+	stale := time.Since(p.keysAt) >= oidcJWKSRefresh
+	p.mutex.Unlock()
+	if ok || !stale {
+		return k, nil
+	}
+
+	d, err := p.Discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if pub, err := jwk.publicKey(); err != nil {
+			log.Println(err)
+		} else {
+			keys[jwk.Kid] = pub
+		}
+	}
+	p.mutex.Lock()
+	p.keys, p.keysAt = keys, time.Now()
+	p.mutex.Unlock()
+	return keys[kid], nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// AuthURL is where the user is sent to log in.
+func (p *OIDCProvider) AuthURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	d, err := p.Discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified claims
+// of the ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURL, code, verifier, nonce string) (*IDTokenClaims, error) {
+	d, err := p.Discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: unexpected status %d", res.StatusCode)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := decoder.NewDecoder(string(b)).Decode(&token); err != nil {
+		return nil, err
+	}
+	return p.VerifyIDToken(ctx, token.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature of an RS256 or ES256 ID token against
+// the provider's keys and its issuer, audience, expiry and nonce.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidIDToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errInvalidIDToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errInvalidIDToken
+		}
+	default:
+		// unknown kid; "none" and HMAC tokens end up here too
+		return nil, errInvalidIDToken
+	}
+
+	var claims IDTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidIDToken
+	}
+	now := time.Now()
+	if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer || claims.Subject == "" {
+		return nil, errInvalidIDToken
+	}
+	if !claims.hasAudience(p.ClientID) {
+		return nil, errInvalidIDToken
+	}
+	if now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)) || time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errInvalidIDToken
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errInvalidIDToken
+	}
+	return &claims, nil
+}
+
+func (c *IDTokenClaims) hasAudience(clientID string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		found := false
+		for _, a := range aud {
+			found = found || a == clientID
+		}
+		// with several audiences the token must have been issued to us
+		return found && (len(aud) == 1 || c.AuthorizedParty == clientID)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return decoder.NewDecoder(string(b)).Decode(v)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oidcRedirectURL(c echo.Context) string {
+	if oidcProvider.RedirectURL != "" {
+		return oidcProvider.RedirectURL
+	}
+	return fmt.Sprintf("%s://%s/login/oidc/callback", c.Scheme(), c.Request().Host)
+}
+
+// getOIDCLogin starts the login. The state, nonce and PKCE verifier wait in
+// the session cookie for the callback.
+func getOIDCLogin(c echo.Context) error {
+	if oidcProvider == nil {
+		return echo.ErrNotFound
+	}
+	sess, _ := session.Get("session", c)
+	values := make(map[string]string, 3)
+	for _, k := range []string{"oidc_state", "oidc_nonce", "oidc_verifier"} {
+		v, err := randomToken()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		values[k] = v
+		sess.Values[k] = v
+	}
+	u, err := oidcProvider.AuthURL(c.Request().Context(), oidcRedirectURL(c), values["oidc_state"], values["oidc_nonce"], values["oidc_verifier"])
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusBadGateway, "identity provider unavailable")
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, u)
+}
+
+// getOIDCCallback finishes the login. A logged in user gets the identity
+// linked to their account, anyone else is logged in to the linked account,
+// which is created on first login.
+func getOIDCCallback(c echo.Context) error {
+	if oidcProvider == nil {
+		return echo.ErrNotFound
+	}
+	sess, _ := session.Get("session", c)
+	state, _ := sess.Values["oidc_state"].(string)
+	nonce, _ := sess.Values["oidc_nonce"].(string)
+	verifier, _ := sess.Values["oidc_verifier"].(string)
+	delete(sess.Values, "oidc_state")
+	delete(sess.Values, "oidc_nonce")
+	delete(sess.Values, "oidc_verifier")
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.QueryParam("state"))) != 1 {
+		return echo.ErrForbidden
+	}
+	if e := c.QueryParam("error"); e != "" || c.QueryParam("code") == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "login was not completed")
+	}
+	claims, err := oidcProvider.Exchange(c.Request().Context(), oidcRedirectURL(c), c.QueryParam("code"), verifier, nonce)
+	if err != nil {
+		log.Println(err)
+		return echo.ErrForbidden
+	}
+
+	var userID int64
+	err = db.Get(&userID, "SELECT user_id FROM user_identity WHERE issuer = ? AND subject = ?", oidcProvider.Issuer, claims.Subject)
+	if err == sql.ErrNoRows {
+		userID = sessUserID(c)
+		if userID == 0 {
+			if userID, err = registerOIDCUser(claims); err != nil {
+				log.Println(err)
+				return err
+			}
+		}
+		if _, err := db.Exec("INSERT INTO user_identity (issuer, subject, user_id, created_at) VALUES (?, ?, ?, NOW())",
+			oidcProvider.Issuer, claims.Subject, userID); err != nil {
+			log.Println(err)
+			return err
+		}
+	} else if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	// the provider stands in for the password, not for the second factor
+	if t, err := queryTOTP(userID); err != nil {
+		log.Println(err)
+		return err
+	} else if t != nil && t.Enabled {
+		return beginSecondFactor(c, userID)
+	}
+	if err := sessSetUserID(c, userID); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// registerOIDCUser creates a user without a password, named after the
+// provider's username or email when that name is still free.
+func registerOIDCUser(claims *IDTokenClaims) (int64, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = userNameInvalid.ReplaceAllString(base, "")
+	if len(base) > 32 {
+		base = base[:32]
+	}
+	if base == "" || reservedUserName(base) {
+		base = "user"
+	}
+	displayName := claims.Name
+	if displayName == "" {
+		displayName = base
+	}
+
+	name := base
+	for i := 0; i < 5; i++ {
+		res, err := db.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
+			" VALUES (?, '', '', ?, ?, NOW())", name, displayName, "default.png")
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+			name = base + "-" + randomString(4)
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		emitEvent(eventUserRegistered, 0, map[string]interface{}{"id": id, "name": name})
+		return id, nil
+	}
+	return 0, errors.New("no free user name for " + base)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic/encoder"
+)
+
+// fakeOIDCProvider is an identity provider serving discovery, a key set and
+// a token endpoint that checks the PKCE verifier.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	t *testing.T
+
+	mutex sync.Mutex
+	// keys are published in the key set, signer signs the ID tokens
+	keys      map[string]crypto.Signer
+	signerKid string
+	// issued maps codes to the PKCE challenge and the claims to return
+	issued map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	f := &fakeOIDCProvider{t: t, keys: make(map[string]crypto.Signer), issued: make(map[string]fakeGrant)}
+	f.addRSAKey("rsa1")
+	f.signerKid = "rsa1"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, map[string]interface{}{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		keys := make([]map[string]interface{}, 0, len(f.keys))
+		for kid, k := range f.keys {
+			keys = append(keys, jwkOf(kid, k.Public()))
+		}
+		f.writeJSON(w, map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		grant, ok := f.issued[r.FormValue("code")]
+		delete(f.issued, r.FormValue("code"))
+		f.mutex.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("grant_type") != "authorization_code" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.writeJSON(w, map[string]interface{}{"id_token": f.sign(grant.claims)})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOIDCProvider) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := encoder.Encode(v, 0)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (f *fakeOIDCProvider) addRSAKey(kid string) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mutex.Lock()
+	f.keys[kid] = k
+	f.mutex.Unlock()
+}
+
+func (f *fakeOIDCProvider) addECKey(kid string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.mutex.Lock()
+	f.keys[kid] = k
+	f.mutex.Unlock()
+}
+
+func jwkOf(kid string, pub crypto.PublicKey) map[string]interface{} {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]interface{}{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]interface{}{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+	}
+	return nil
+}
+
+// sign makes an ID token with the current signer key.
+func (f *fakeOIDCProvider) sign(claims map[string]interface{}) string {
+	f.mutex.Lock()
+	kid := f.signerKid
+	key := f.keys[kid]
+	f.mutex.Unlock()
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := encoder.Encode(map[string]interface{}{"alg": alg, "kid": kid, "typ": "JWT"}, 0)
+	payload, _ := encoder.Encode(claims, 0)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			f.t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (f *fakeOIDCProvider) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   f.URL,
+		"sub":   "user-1",
+		"aud":   "client",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+	}
+}
+
+func (f *fakeOIDCProvider) client() *OIDCProvider {
+	return &OIDCProvider{Issuer: f.URL, ClientID: "client", Client: f.Client()}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	d, err := f.client().Discovery(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenEndpoint != f.URL+"/token" || d.JWKSURI != f.URL+"/jwks" {
+		t.Fatalf("unexpected discovery document %+v", d)
+	}
+
+	// the document must be about the configured issuer
+	other := &OIDCProvider{Issuer: f.URL + "/other", ClientID: "client", Client: f.Client()}
+	if _, err := other.Discovery(context.Background()); err == nil {
+		t.Fatal("accepted a discovery document for another issuer")
+	}
+}
+
+func TestOIDCPKCERoundTrip(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	p := f.client()
+	ctx := context.Background()
+
+	authURL, err := p.AuthURL(ctx, "https://app.example/callback", "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("state") != "state" || q.Get("nonce") != "nonce" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	f.issued["code"] = fakeGrant{challenge: q.Get("code_challenge"), claims: f.claims("nonce")}
+	claims, err := p.Exchange(ctx, "https://app.example/callback", "code", "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" {
+		t.Fatalf("subject = %q", claims.Subject)
+	}
+
+	// a code redeemed with the wrong verifier is refused by the provider
+	f.issued["code2"] = fakeGrant{challenge: q.Get("code_challenge"), claims: f.claims("nonce")}
+	if _, err := p.Exchange(ctx, "https://app.example/callback", "code2", "other-verifier", "nonce"); err == nil {
+		t.Fatal("exchange with the wrong verifier succeeded")
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	p := f.client()
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		edit func(map[string]interface{})
+		ok   bool
+	}{
+		"valid":              {func(map[string]interface{}) {}, true},
+		"wrong nonce":        {func(c map[string]interface{}) { c["nonce"] = "other" }, false},
+		"wrong audience":     {func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		"audiences, no azp":  {func(c map[string]interface{}) { c["aud"] = []string{"client", "other"} }, false},
+		"audiences, our azp": {func(c map[string]interface{}) { c["aud"], c["azp"] = []string{"client", "other"}, "client" }, true},
+		"audiences, foreign azp": {func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"client", "other"}, "other"
+		}, false},
+		"wrong issuer": {func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, false},
+		"expired":      {func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, false},
+	} {
+		claims := f.claims("nonce")
+		tc.edit(claims)
+		_, err := p.VerifyIDToken(ctx, f.sign(claims), "nonce")
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// unsigned tokens are never accepted
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa1"}`))
+	payload, _ := encoder.Encode(f.claims("nonce"), 0)
+	if _, err := p.VerifyIDToken(ctx, header+"."+base64.RawURLEncoding.EncodeToString(payload)+".", "nonce"); err == nil {
+		t.Error("accepted an unsigned token")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	f := newFakeOIDCProvider(t)
+	p := f.client()
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, f.sign(f.claims("n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider rotates to a new EC key
+	f.addECKey("ec2")
+	f.mutex.Lock()
+	f.signerKid = "ec2"
+	f.mutex.Unlock()
+
+	// the key set was just fetched, an unknown kid doesn't refetch it yet
+	if _, err := p.VerifyIDToken(ctx, f.sign(f.claims("n")), "n"); err == nil {
+		t.Fatal("accepted a token signed by a key that was not fetched")
+	}
+	p.mutex.Lock()
+	p.keysAt = time.Now().Add(-oidcJWKSRefresh)
+	p.mutex.Unlock()
+	if _, err := p.VerifyIDToken(ctx, f.sign(f.claims("n")), "n"); err != nil {
+		t.Fatalf("token signed by the rotated key: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher produces self-describing hash strings: the algorithm is
+// encoded in the prefix of the stored value.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(encoded, password string) (bool, error)
+	// Handles reports whether encoded was produced by this algorithm.
+	Handles(encoded string) bool
+}
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) Verify(encoded, password string) (bool, error) {
+	// $argon2id$v=19$m=19456,t=2,p=1$salt$key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errUnknownHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errUnknownHash
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *argon2idHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(b), err
+}
+
+func (h *bcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+var (
+	passwordHashers = map[string]PasswordHasher{
+		// OWASP's minimum recommendation, cheap enough for the login rate here
+		"argon2id": &argon2idHasher{time: 2, memory: 19 * 1024, threads: 1, keyLen: 32},
+		"bcrypt":   &bcryptHasher{cost: bcrypt.DefaultCost},
+	}
+	passwordHasher = passwordHashers["argon2id"]
+)
+
+// initPasswordHasher picks the algorithm for new hashes from
+// ISUBATA_PASSWORD_HASH, argon2id or bcrypt. Hashes of the other algorithm
+// keep verifying and are rehashed on the next login.
+func initPasswordHasher() error {
+	name := os.Getenv("ISUBATA_PASSWORD_HASH")
+	if name == "" {
+		return nil
+	}
+	h, ok := passwordHashers[name]
+	if !ok {
+		return fmt.Errorf("unknown password hash %q", name)
+	}
+	passwordHasher = h
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// verifyPassword checks password against the stored hash of u. rehash is
+// set when the hash should be replaced by one of the current algorithm,
+// which is always the case for the legacy sha1(salt+password) digests.
+func verifyPassword(u *User, password string) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(u.Password, "$") {
+		digest := fmt.Sprintf("%x", sha1.Sum([]byte(u.Salt+password)))
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(u.Password)) == 1, true, nil
+	}
+	for _, h := range passwordHashers {
+		if h.Handles(u.Password) {
+			ok, err := h.Verify(u.Password, password)
+			return ok, h != passwordHasher, err
+		}
+	}
+	return false, false, errUnknownHash
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/bytedance/sonic/encoder"
+	"github.com/labstack/echo/v4"
+)
+
+// Peers keep the in-memory state of every app node (channelCacher and the
+// stream broadcaster) in sync. Configuration is read from the environment:
+//
+//	ISUBATA_NODE_ID      name of this node, defaults to the hostname
+//	ISUBATA_PEERS        comma separated peer addresses, e.g.
+//	                     "http://172.31.5.58:5000" or "tcp://172.31.5.58:5001"
+//	ISUBATA_PEER_SECRET  shared secret every node must agree on
+//	ISUBATA_PEER_LISTEN  address to accept tcp:// peers on, e.g. ":5001"
+
+const (
+	peerEventChannelCreated = "channel_created"
+	peerEventChannelUpdated = "channel_updated"
+	peerEventTopicUpdated   = "topic_updated"
+	peerEventMembersAdded   = "members_added"
+	peerEventMembersRemoved = "members_removed"
+	peerEventMessageAdded   = "message_added"
+	peerEventMessageEdited  = "message_edited"
+	peerEventMessageDeleted = "message_deleted"
+	peerEventReaction       = "reaction"
+	peerEventInvalidate     = "invalidate"
+
+	peerEventSubscriptionsChanged = "subscriptions_changed"
+	peerEventSessionsRevoked      = "sessions_revoked"
+
+	peerSecretHeader  = "X-Isubata-Peer-Secret"
+	peerQueueSize     = 1024
+	peerSendTimeout   = 3 * time.Second
+	peerSendRetries   = 3
+	peerMaxFrameBytes = 1 * 1024 * 1024
+)
+
+type PeerEvent struct {
+	Type      string         `json:"type"`
+	Origin    string         `json:"origin"`
+	ChannelID int64          `json:"channel_id,omitempty"`
+	Channel   *ChannelInfo   `json:"channel,omitempty"`
+	Members   []int64        `json:"members,omitempty"`
+	Role      string         `json:"role,omitempty"`
+	Message   *Message       `json:"message,omitempty"`
+	Reaction  *ReactionEvent `json:"reaction,omitempty"`
+}
+
+type PeerTransport interface {
+	Send(ctx context.Context, ev *PeerEvent) error
+	Close() error
+}
+
+type peer struct {
+	addr      string
+	transport PeerTransport
+	queue     chan *PeerEvent
+}
+
+func (p *peer) run() {
+	for ev := range p.queue {
+		var err error
+		for i := 0; i < peerSendRetries; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), peerSendTimeout)
+			err = p.transport.Send(ctx, ev)
+			cancel()
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+		}
+		if err != nil {
+			log.Printf("peer %s: dropped %s event: %v", p.addr, ev.Type, err)
+		}
+	}
+}
+
+type PeerBroadcaster struct {
+	nodeID string
+	secret string
+	peers  []*peer
+}
+
+func newPeerBroadcaster(nodeID, secret string, addrs []string) (*PeerBroadcaster, error) {
+	b := &PeerBroadcaster{nodeID: nodeID, secret: secret}
+	for _, addr := range addrs {
+		t, err := newPeerTransport(addr, secret)
+		if err != nil {
+			return nil, err
+		}
+		p := &peer{addr: addr, transport: t, queue: make(chan *PeerEvent, peerQueueSize)}
+		go p.run()
+		b.peers = append(b.peers, p)
+	}
+	return b, nil
+}
+
+func newPeerTransport(addr, secret string) (PeerTransport, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpPeerTransport{endpoint: strings.TrimRight(addr, "/") + "/peer/event", secret: secret}, nil
+	case "tcp":
+		return &tcpPeerTransport{addr: u.Host, secret: secret}, nil
+	default:
+		return nil, fmt.Errorf("unsupported peer address %q", addr)
+	}
+}
+
+// Broadcast queues ev for every peer without waiting for delivery.
+func (b *PeerBroadcaster) Broadcast(ev *PeerEvent) {
+	if b == nil {
+		return
+	}
+	ev.Origin = b.nodeID
+	for _, p := range b.peers {
+		select {
+		case p.queue <- ev:
+		default:
+			log.Printf("peer %s: queue is full, dropped %s event", p.addr, ev.Type)
+		}
+	}
+}
+
+// BroadcastSync delivers ev to every peer and waits for all of them.
+func (b *PeerBroadcaster) BroadcastSync(ctx context.Context, ev *PeerEvent) error {
+	if b == nil {
+		return nil
+	}
+	ev.Origin = b.nodeID
+	errs := make(chan error, len(b.peers))
+	for _, p := range b.peers {
+		go func(p *peer) {
+			if err := p.transport.Send(ctx, ev); err != nil {
+				errs <- fmt.Errorf("peer %s: %w", p.addr, err)
+				return
+			}
+			errs <- nil
+		}(p)
+	}
+	var firstErr error
+	for range b.peers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *PeerBroadcaster) authorized(secret string) bool {
+	return b != nil && b.secret != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(b.secret)) == 1
+}
+
+func (b *PeerBroadcaster) apply(ev *PeerEvent) error {
+	if ev.Origin == b.nodeID {
+		return nil
+	}
+	switch ev.Type {
+	case peerEventChannelCreated:
+		if ev.Channel == nil {
+			return fmt.Errorf("%s event without channel", ev.Type)
+		}
+		channelCacher.Set(channelKey(ev.Channel.ID), ev.Channel, -1)
+		channelCacher.AddMembers(channelKey(ev.Channel.ID), ev.Role, ev.Members...)
+	case peerEventChannelUpdated:
+		if ev.Channel == nil {
+			return fmt.Errorf("%s event without channel", ev.Type)
+		}
+		channelCacher.UpdateChannel(channelKey(ev.ChannelID), ev.Channel.Name, ev.Channel.Description, ev.Channel.UpdatedAt)
+	case peerEventTopicUpdated:
+		if ev.Channel == nil {
+			return fmt.Errorf("%s event without channel", ev.Type)
+		}
+		channelCacher.UpdateDescription(channelKey(ev.ChannelID), ev.Channel.Description, ev.Channel.UpdatedAt)
+	case peerEventMembersAdded:
+		// also sent when the role of existing members changes
+		channelCacher.AddMembers(channelKey(ev.ChannelID), ev.Role, ev.Members...)
+	case peerEventMembersRemoved:
+		channelCacher.RemoveMembers(channelKey(ev.ChannelID), ev.Members...)
+		broadcaster.Publish(&StreamEvent{Type: streamEventMembersRemoved, ChannelID: ev.ChannelID, Members: ev.Members})
+	case peerEventMessageAdded:
+		if ev.Message == nil {
+			return fmt.Errorf("%s event without message", ev.Type)
+		}
+		if ev.Message.ParentID == nil {
+			channelCacher.IncrementMessage(channelKey(ev.ChannelID))
+		}
+		if err := searchIndex.Index(ev.Message); err != nil {
+			return err
+		}
+		broadcaster.PublishMessage(ev.Message)
+	case peerEventMessageEdited:
+		if ev.Message == nil {
+			return fmt.Errorf("%s event without message", ev.Type)
+		}
+		if err := searchIndex.Index(ev.Message); err != nil {
+			return err
+		}
+		broadcaster.Publish(&StreamEvent{Type: streamEventMessageEdited, ChannelID: ev.ChannelID, Message: ev.Message})
+	case peerEventMessageDeleted:
+		if ev.Message == nil {
+			return fmt.Errorf("%s event without message", ev.Type)
+		}
+		if ev.Message.ParentID == nil {
+			channelCacher.DecrementMessage(channelKey(ev.ChannelID))
+		}
+		if err := searchIndex.Remove(ev.Message.ID); err != nil {
+			return err
+		}
+		broadcaster.Publish(&StreamEvent{Type: streamEventMessageEdited, ChannelID: ev.ChannelID, Message: ev.Message})
+	case peerEventReaction:
+		if ev.Reaction == nil {
+			return fmt.Errorf("%s event without reaction", ev.Type)
+		}
+		broadcaster.Publish(&StreamEvent{Type: streamEventReaction, ChannelID: ev.ChannelID, Reaction: ev.Reaction})
+	case peerEventSubscriptionsChanged:
+		subscriptionCacher.Delete("all")
+	case peerEventSessionsRevoked:
+		for _, userID := range ev.Members {
+			sessionGenCacher.Delete(strconv.FormatInt(userID, 10))
+		}
+		broadcaster.Publish(&StreamEvent{Type: streamEventSessionsRevoked, Members: ev.Members})
+	case peerEventInvalidate:
+		if err := loadChannelCache(); err != nil {
+			return err
+		}
+		return searchIndex.Rebuild()
+	default:
+		return fmt.Errorf("unknown peer event %q", ev.Type)
+	}
+	return nil
+}
+
+type httpPeerTransport struct {
+	endpoint string
+	secret   string
+}
+
+func (t *httpPeerTransport) Send(ctx context.Context, ev *PeerEvent) error {
+	buf, err := encoder.Encode(ev, 0)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(peerSecretHeader, t.secret)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (t *httpPeerTransport) Close() error {
+	return nil
+}
+
+// tcpPeerTransport writes newline delimited JSON over a long-lived
+// connection. The first line of every connection is the shared secret.
+type tcpPeerTransport struct {
+	addr   string
+	secret string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (t *tcpPeerTransport) Send(ctx context.Context, ev *PeerEvent) error {
+	buf, err := encoder.Encode(ev, 0)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(conn, "%s\n", t.secret); err != nil {
+			conn.Close()
+			return err
+		}
+		t.conn = conn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		t.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := t.conn.Write(append(buf, '\n')); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (t *tcpPeerTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func (b *PeerBroadcaster) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go b.handleTCPConn(conn)
+	}
+}
+
+func (b *PeerBroadcaster) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), peerMaxFrameBytes)
+	if !scanner.Scan() || !b.authorized(scanner.Text()) {
+		log.Printf("peer %s: rejected tcp connection", conn.RemoteAddr())
+		return
+	}
+	for scanner.Scan() {
+		ev := PeerEvent{}
+		if err := decoder.NewDecoder(scanner.Text()).Decode(&ev); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := b.apply(&ev); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+func postPeerEvent(c echo.Context) error {
+	if !peers.authorized(c.Request().Header.Get(peerSecretHeader)) {
+		return echo.ErrForbidden
+	}
+	ev := PeerEvent{}
+	if err := c.Bind(&ev); err != nil {
+		return ErrBadReqeust
+	}
+	if err := peers.apply(&ev); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+var peers *PeerBroadcaster
+
+func initPeers() error {
+	nodeID := os.Getenv("ISUBATA_NODE_ID")
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+	secret := os.Getenv("ISUBATA_PEER_SECRET")
+
+	var addrs []string
+	for _, addr := range strings.Split(os.Getenv("ISUBATA_PEERS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 0 && secret == "" {
+		return fmt.Errorf("ISUBATA_PEER_SECRET is required when ISUBATA_PEERS is set")
+	}
+
+	b, err := newPeerBroadcaster(nodeID, secret, addrs)
+	if err != nil {
+		return err
+	}
+	if listen := os.Getenv("ISUBATA_PEER_LISTEN"); listen != "" {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		go b.serveTCP(ln)
+	}
+	peers = b
+	return nil
+}
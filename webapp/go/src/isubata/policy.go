@@ -0,0 +1,54 @@
+package main
+
+// Action is something a user may try to do in a channel.
+type Action int
+
+const (
+	ActionRead Action = iota
+	ActionPost
+	ActionEditMessage
+	ActionDeleteMessage
+	ActionEditChannel
+	ActionInvite
+	ActionLeave
+	ActionSetRole
+	ActionManageWebhooks
+)
+
+const (
+	roleOwner     = "owner"
+	roleModerator = "moderator"
+	roleMember    = "member"
+)
+
+// authorize is the single place that decides whether userID may perform
+// action in chanID. authorID is the author of the message acted on and is
+// only looked at for message actions.
+func authorize(userID, chanID int64, action Action, authorID int64) (bool, error) {
+	ch, err := getChannelInfo(chanID)
+	if err != nil || ch == nil {
+		return false, err
+	}
+	role := channelCacher.MemberRole(channelKey(chanID), userID)
+	canRead := ch.Kind == channelKindPublic || role != ""
+	moderator := role == roleOwner || role == roleModerator
+
+	switch action {
+	case ActionRead, ActionPost:
+		return canRead, nil
+	case ActionEditMessage:
+		return canRead && authorID == userID, nil
+	case ActionDeleteMessage:
+		return canRead && (authorID == userID || moderator), nil
+	case ActionEditChannel:
+		return ch.Kind != channelKindDM && moderator, nil
+	case ActionInvite:
+		return ch.Kind == channelKindPrivate && role != "", nil
+	case ActionLeave:
+		// the owner would leave the channel unmanageable
+		return ch.Kind == channelKindPrivate && role != "" && role != roleOwner, nil
+	case ActionSetRole, ActionManageWebhooks:
+		return ch.Kind != channelKindDM && role == roleOwner, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var emojiPattern = regexp.MustCompile(`^[a-z0-9_+\-]{1,32}$`)
+
+type ReactionEvent struct {
+	MessageID int64  `json:"message_id"`
+	UserID    int64  `json:"user_id"`
+	Emoji     string `json:"emoji"`
+	Count     int64  `json:"count"`
+	Added     bool   `json:"added"`
+}
+
+type ReactionSummary struct {
+	MessageID int64  `db:"message_id"`
+	Emoji     string `db:"emoji"`
+	Count     int64  `db:"cnt"`
+	Me        bool   `db:"me"`
+}
+
+// queryReactions aggregates the reactions of msgIDs in a single query.
+func queryReactions(userID int64, msgIDs []int64) (map[int64][]map[string]interface{}, error) {
+	res := make(map[int64][]map[string]interface{}, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return res, nil
+	}
+	query, args, err := sqlx.In("SELECT message_id, emoji, COUNT(*) AS cnt, SUM(user_id = ?) > 0 AS me FROM reaction"+
+		" WHERE message_id IN (?) GROUP BY message_id, emoji ORDER BY MIN(created_at)", userID, msgIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*ReactionSummary, 0)
+	if err := db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		res[r.MessageID] = append(res[r.MessageID], map[string]interface{}{
+			"emoji": r.Emoji,
+			"count": r.Count,
+			"me":    r.Me,
+		})
+	}
+	return res, nil
+}
+
+func parseEmoji(s string) (string, bool) {
+	s = strings.Trim(s, ":")
+	return s, emojiPattern.MatchString(s)
+}
+
+func postReaction(c echo.Context) error {
+	return updateReaction(c, true)
+}
+
+func deleteReaction(c echo.Context) error {
+	return updateReaction(c, false)
+}
+
+func updateReaction(c echo.Context, add bool) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	emoji, ok := parseEmoji(c.FormValue("emoji"))
+	if !ok {
+		return ErrBadReqeust
+	}
+
+	m, err := queryMessageWithUser(msgID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if m == nil || m.DeletedAt != nil {
+		return echo.ErrNotFound
+	}
+	if ok, err := authorize(userID, m.ChannelID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	if add {
+		_, err = db.Exec("INSERT IGNORE INTO reaction (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)",
+			msgID, userID, emoji, time.Now())
+	} else {
+		_, err = db.Exec("DELETE FROM reaction WHERE message_id = ? AND user_id = ? AND emoji = ?",
+			msgID, userID, emoji)
+	}
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	var cnt int64
+	if err := db.Get(&cnt, "SELECT COUNT(*) FROM reaction WHERE message_id = ? AND emoji = ?", msgID, emoji); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	ev := &ReactionEvent{MessageID: msgID, UserID: userID, Emoji: emoji, Count: cnt, Added: add}
+	peers.Broadcast(&PeerEvent{Type: peerEventReaction, ChannelID: m.ChannelID, Reaction: ev})
+	broadcaster.Publish(&StreamEvent{Type: streamEventReaction, ChannelID: m.ChannelID, Reaction: ev})
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message_id": msgID,
+		"emoji":      emoji,
+		"count":      cnt,
+		"me":         add,
+	})
+}
+
+// reactionJSON is the reaction event as seen by userID.
+func reactionJSON(ev *ReactionEvent, userID int64) map[string]interface{} {
+	r := map[string]interface{}{
+		"message_id": ev.MessageID,
+		"emoji":      ev.Emoji,
+		"count":      ev.Count,
+	}
+	if ev.UserID == userID {
+		r["me"] = ev.Added
+	}
+	return r
+}
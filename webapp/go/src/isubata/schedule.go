@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	jobKindMessage  = "message"
+	jobKindReminder = "reminder"
+
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	scheduleMaxAhead = 365 * 24 * time.Hour
+)
+
+// ScheduledJob is a message to post or a reminder to send later. Reminders
+// go to the user's own direct message channel and may point at a message.
+type ScheduledJob struct {
+	ID     int64  `db:"id"`
+	Kind   string `db:"kind"`
+	UserID int64  `db:"user_id"`
+	// ChannelID and ParentID are where a scheduled message goes, 0 and nil
+	// for reminders.
+	ChannelID   int64      `db:"channel_id"`
+	ParentID    *int64     `db:"parent_id"`
+	MessageID   *int64     `db:"message_id"`
+	Content     string     `db:"content"`
+	RunAt       time.Time  `db:"run_at"`
+	Status      string     `db:"status"`
+	Attempts    int        `db:"attempts"`
+	LockedUntil *time.Time `db:"locked_until"`
+	LastError   *string    `db:"last_error"`
+	DoneAt      *time.Time `db:"done_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+func scheduleJob(j *ScheduledJob) (int64, error) {
+	res, err := db.Exec("INSERT INTO scheduled_job (kind, user_id, channel_id, parent_id, message_id, content, run_at, status, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())",
+		j.Kind, j.UserID, j.ChannelID, j.ParentID, j.MessageID, j.Content, j.RunAt, jobPending)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Scheduler runs the due jobs. Every node runs one: a job is claimed by
+// taking a lease on it, and a node that dies while running a job leaves the
+// lease to expire so that another node retries it. A job can therefore run
+// twice, but is never lost.
+type Scheduler struct {
+	Interval    time.Duration
+	BatchSize   int
+	Lease       time.Duration
+	MaxAttempts int
+}
+
+func newScheduler() *Scheduler {
+	return &Scheduler{
+		Interval:    time.Second,
+		BatchSize:   50,
+		Lease:       time.Minute,
+		MaxAttempts: 5,
+	}
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.RunDue(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) RunDue() error {
+	jobs := make([]*ScheduledJob, 0, s.BatchSize)
+	if err := db.Select(&jobs, "SELECT * FROM scheduled_job WHERE status = ? AND run_at <= NOW()"+
+		" AND (locked_until IS NULL OR locked_until <= NOW()) ORDER BY run_at LIMIT ?", jobPending, s.BatchSize); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		res, err := db.Exec("UPDATE scheduled_job SET locked_until = ?, attempts = attempts + 1"+
+			" WHERE id = ? AND status = ? AND attempts = ?", time.Now().Add(s.Lease), j.ID, jobPending, j.Attempts)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// claimed by another node
+			continue
+		}
+		j.Attempts++
+
+		// every attempt so far was cut off before it could record a result,
+		// e.g. by a crash while running it
+		if j.Attempts > s.MaxAttempts {
+			if _, err := db.Exec("UPDATE scheduled_job SET status = ?, last_error = ? WHERE id = ?",
+				jobFailed, "too many interrupted attempts", j.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		runErr := runJob(j)
+		if runErr == nil {
+			if _, err := db.Exec("UPDATE scheduled_job SET status = ?, done_at = NOW() WHERE id = ?", jobDone, j.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Println(runErr)
+
+		// validation errors won't go away by retrying
+		_, permanent := runErr.(*echo.HTTPError)
+		status := jobPending
+		if permanent || j.Attempts >= s.MaxAttempts {
+			status = jobFailed
+		}
+		retryAt := time.Now().Add(time.Duration(j.Attempts) * s.Lease)
+		if _, err := db.Exec("UPDATE scheduled_job SET status = ?, locked_until = ?, last_error = ? WHERE id = ?",
+			status, retryAt, runErr.Error(), j.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runJob(j *ScheduledJob) error {
+	user, err := getUser(j.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return echo.ErrNotFound
+	}
+
+	switch j.Kind {
+	case jobKindMessage:
+		// the user may have lost access since scheduling, so check again
+		var parentID int64
+		if j.ParentID != nil {
+			parentID = *j.ParentID
+		}
+		_, err := createMessage(user, j.ChannelID, parentID, j.Content)
+		return err
+	case jobKindReminder:
+		content := "リマインダー: " + j.Content
+		if j.MessageID != nil {
+			m, err := queryMessageWithUser(*j.MessageID)
+			if err != nil {
+				return err
+			}
+			if m != nil && m.DeletedAt == nil {
+				if ok, err := authorize(user.ID, m.ChannelID, ActionRead, 0); err != nil {
+					return err
+				} else if ok {
+					content = strings.TrimSpace(content + "\n" + m.Content + "\n" + messageURL(m))
+				}
+			}
+		}
+		dmID, err := findOrCreateDM([]int64{user.ID}, []string{user.Name})
+		if err != nil {
+			return err
+		}
+		_, err = addMessage(dmID, user.ID, content)
+		return err
+	}
+	return fmt.Errorf("unknown job kind %q", j.Kind)
+}
+
+// parseRunAt reads when a job should run, either from a delay like "30m"
+// or from a time in RFC 3339 or in the "2006-01-02T15:04" local time sent by
+// datetime-local inputs.
+func parseRunAt(delay, at string) (time.Time, error) {
+	now := time.Now()
+	var t time.Time
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return t, ErrBadReqeust
+		}
+		t = now.Add(d)
+	} else if at != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, at); err != nil {
+			if t, err = time.ParseInLocation("2006-01-02T15:04", at, time.Local); err != nil {
+				return t, ErrBadReqeust
+			}
+		}
+	} else {
+		return t, ErrBadReqeust
+	}
+	if !t.After(now) || t.Sub(now) > scheduleMaxAhead {
+		return t, echo.NewHTTPError(http.StatusBadRequest, "time must be in the future and within a year")
+	}
+	return t, nil
+}
+
+// postScheduleMessage schedules a message like postMessage would post it.
+func postScheduleMessage(c echo.Context) error {
+	user, err := ensureLogin(c)
+	if user == nil {
+		log.Println(err)
+		return err
+	}
+
+	chanID, err := strconv.ParseInt(c.FormValue("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	var parentID *int64
+	if s := c.FormValue("parent_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+		parentID = &id
+	}
+	content := c.FormValue("message")
+	if content == "" {
+		return ErrBadReqeust
+	}
+	if _, _, ok := parseCommand(content); ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "slash commands cannot be scheduled")
+	}
+	content = strings.TrimPrefix(content, "/")
+	runAt, err := parseRunAt(c.FormValue("send_in"), c.FormValue("send_at"))
+	if err != nil {
+		return err
+	}
+	if ok, err := authorize(user.ID, chanID, ActionPost, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+
+	id, err := scheduleJob(&ScheduledJob{Kind: jobKindMessage, UserID: user.ID, ChannelID: chanID, ParentID: parentID, Content: content, RunAt: runAt})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"id": id, "run_at": runAt.Format("2006/01/02 15:04:05")})
+}
+
+// postMessageReminder reminds the user of a message later.
+func postMessageReminder(c echo.Context) error {
+	user, err := ensureLogin(c)
+	if user == nil {
+		log.Println(err)
+		return err
+	}
+
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	m, err := queryMessageWithUser(msgID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if m == nil || m.DeletedAt != nil {
+		return echo.ErrNotFound
+	}
+	if ok, err := authorize(user.ID, m.ChannelID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return echo.ErrForbidden
+	}
+	runAt, err := parseRunAt(c.FormValue("in"), c.FormValue("at"))
+	if err != nil {
+		return err
+	}
+
+	id, err := scheduleJob(&ScheduledJob{Kind: jobKindReminder, UserID: user.ID, MessageID: &msgID,
+		Content: strings.TrimSpace(c.FormValue("note")), RunAt: runAt})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"id": id, "run_at": runAt.Format("2006/01/02 15:04:05")})
+}
+
+func getScheduled(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	jobs := make([]*ScheduledJob, 0)
+	if err := db.Select(&jobs, "SELECT * FROM scheduled_job WHERE user_id = ? AND (status <> ? OR done_at > NOW() - INTERVAL 1 DAY)"+
+		" ORDER BY run_at DESC LIMIT 100", self.ID, jobDone); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	names := make(map[int64]string, len(channels))
+	for _, ch := range channels {
+		names[ch.ID] = ch.Name
+	}
+	return c.Render(http.StatusOK, "scheduled", map[string]interface{}{
+		"ChannelID":    0,
+		"Channels":     channels,
+		"User":         self,
+		"Jobs":         jobs,
+		"ChannelNames": names,
+	})
+}
+
+func postCancelScheduled(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	jobID, err := strconv.ParseInt(c.Param("job_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	// a job being run right now is cancelled too late, it still goes out
+	res, err := db.Exec("DELETE FROM scheduled_job WHERE id = ? AND user_id = ? AND status = ?", jobID, self.ID, jobPending)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	return c.Redirect(http.StatusSeeOther, "/scheduled")
+}
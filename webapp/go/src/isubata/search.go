@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	searchResultsPerPage = 20
+	snippetRadius        = 40
+)
+
+type SearchQuery struct {
+	Terms      []string
+	ChannelIDs []int64
+	AuthorID   int64
+	Since      time.Time
+	Until      time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+// SearchIndex finds messages by their content. Implementations may return
+// false positives, the caller checks the content of every hit again.
+type SearchIndex interface {
+	// Index adds or replaces a message.
+	Index(m *Message) error
+	Remove(msgID int64) error
+	// Search returns ids of matching messages, newest first.
+	Search(q *SearchQuery) ([]int64, error)
+	// Rebuild drops the index and builds it again from the message table.
+	Rebuild() error
+}
+
+var searchIndex SearchIndex = &mysqlSearchIndex{}
+
+// initSearch picks the index named by ISUBATA_SEARCH: "mysql" (default)
+// uses the FULLTEXT ngram index on message.content, "memory" keeps an
+// inverted index of bigrams in the process.
+func initSearch() error {
+	switch os.Getenv("ISUBATA_SEARCH") {
+	case "", "mysql":
+		searchIndex = &mysqlSearchIndex{}
+	case "memory":
+		searchIndex = newMemorySearchIndex()
+	default:
+		return fmt.Errorf("unknown search index %q", os.Getenv("ISUBATA_SEARCH"))
+	}
+	return searchIndex.Rebuild()
+}
+
+type mysqlSearchIndex struct{}
+
+// MySQL maintains the FULLTEXT index by itself.
+func (*mysqlSearchIndex) Index(m *Message) error   { return nil }
+func (*mysqlSearchIndex) Remove(msgID int64) error { return nil }
+func (*mysqlSearchIndex) Rebuild() error           { return nil }
+
+func (*mysqlSearchIndex) Search(q *SearchQuery) ([]int64, error) {
+	terms := make([]string, 0, len(q.Terms))
+	for _, t := range q.Terms {
+		terms = append(terms, `+"`+strings.ReplaceAll(t, `"`, "")+`"`)
+	}
+	query := "SELECT id FROM message WHERE MATCH(content) AGAINST(? IN BOOLEAN MODE)" +
+		" AND deleted_at IS NULL AND channel_id IN (?) AND id < ?"
+	args := []interface{}{strings.Join(terms, " "), q.ChannelIDs, q.BeforeID}
+	if q.AuthorID != 0 {
+		query += " AND user_id = ?"
+		args = append(args, q.AuthorID)
+	}
+	if !q.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, q.Since)
+	}
+	if !q.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, q.Until)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, q.Limit)
+	err = db.Select(&ids, query, args...)
+	return ids, err
+}
+
+type indexedMessage struct {
+	channelID int64
+	userID    int64
+	createdAt time.Time
+	tokens    []string
+}
+
+type memorySearchIndex struct {
+	sync.RWMutex
+	// token -> ascending message ids
+	postings map[string][]int64
+	docs     map[int64]*indexedMessage
+}
+
+func newMemorySearchIndex() *memorySearchIndex {
+	return &memorySearchIndex{
+		postings: make(map[string][]int64),
+		docs:     make(map[int64]*indexedMessage),
+	}
+}
+
+func lowerRunes(s string) []rune {
+	rs := []rune(s)
+	for i, r := range rs {
+		rs[i] = unicode.ToLower(r)
+	}
+	return rs
+}
+
+// contentTokens returns the distinct unigrams and bigrams of s.
+func contentTokens(s string) []string {
+	rs := lowerRunes(s)
+	seen := make(map[string]bool, 2*len(rs))
+	tokens := make([]string, 0, 2*len(rs))
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	for i, r := range rs {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		add(string(r))
+		if i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			add(string(rs[i : i+2]))
+		}
+	}
+	return tokens
+}
+
+// termTokens returns the tokens a message must contain to match term.
+func termTokens(term string) []string {
+	rs := lowerRunes(term)
+	if len(rs) == 1 {
+		return []string{string(rs)}
+	}
+	tokens := make([]string, 0, len(rs)-1)
+	for i := 0; i+1 < len(rs); i++ {
+		tokens = append(tokens, string(rs[i:i+2]))
+	}
+	return tokens
+}
+
+func (x *memorySearchIndex) Index(m *Message) error {
+	x.Lock()
+	defer x.Unlock()
+	x.remove(m.ID)
+	doc := &indexedMessage{channelID: m.ChannelID, userID: m.UserID, createdAt: m.CreatedAt, tokens: contentTokens(m.Content)}
+	for _, t := range doc.tokens {
+		ids := x.postings[t]
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= m.ID })
+		ids = append(ids, 0)
+		copy(ids[i+1:], ids[i:])
+		ids[i] = m.ID
+		x.postings[t] = ids
+	}
+	x.docs[m.ID] = doc
+	return nil
+}
+
+func (x *memorySearchIndex) Remove(msgID int64) error {
+	x.Lock()
+	defer x.Unlock()
+	x.remove(msgID)
+	return nil
+}
+
+func (x *memorySearchIndex) remove(msgID int64) {
+	doc, ok := x.docs[msgID]
+	if !ok {
+		return
+	}
+	for _, t := range doc.tokens {
+		ids := x.postings[t]
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= msgID })
+		if i < len(ids) && ids[i] == msgID {
+			ids = append(ids[:i], ids[i+1:]...)
+		}
+		if len(ids) == 0 {
+			delete(x.postings, t)
+		} else {
+			x.postings[t] = ids
+		}
+	}
+	delete(x.docs, msgID)
+}
+
+func (x *memorySearchIndex) contains(token string, msgID int64) bool {
+	ids := x.postings[token]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= msgID })
+	return i < len(ids) && ids[i] == msgID
+}
+
+func (x *memorySearchIndex) Search(q *SearchQuery) ([]int64, error) {
+	x.RLock()
+	defer x.RUnlock()
+
+	tokens := make([]string, 0)
+	for _, t := range q.Terms {
+		tokens = append(tokens, termTokens(t)...)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	// walk the shortest posting list and probe the others
+	sort.Slice(tokens, func(i, j int) bool { return len(x.postings[tokens[i]]) < len(x.postings[tokens[j]]) })
+	channels := make(map[int64]bool, len(q.ChannelIDs))
+	for _, id := range q.ChannelIDs {
+		channels[id] = true
+	}
+
+	ids := make([]int64, 0, q.Limit)
+	candidates := x.postings[tokens[0]]
+	for i := len(candidates) - 1; i >= 0 && len(ids) < q.Limit; i-- {
+		id := candidates[i]
+		doc := x.docs[id]
+		if id >= q.BeforeID || !channels[doc.channelID] ||
+			(q.AuthorID != 0 && doc.userID != q.AuthorID) ||
+			(!q.Since.IsZero() && doc.createdAt.Before(q.Since)) ||
+			(!q.Until.IsZero() && !doc.createdAt.Before(q.Until)) {
+			continue
+		}
+		match := true
+		for _, t := range tokens[1:] {
+			if !x.contains(t, id) {
+				match = false
+				break
+			}
+		}
+		if match {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (x *memorySearchIndex) Rebuild() error {
+	const batch = 10000
+	fresh := newMemorySearchIndex()
+	var lastID int64
+	for {
+		msgs := make([]*Message, 0, batch)
+		if err := db.Select(&msgs, "SELECT id, channel_id, user_id, content, created_at FROM message"+
+			" WHERE id > ? AND deleted_at IS NULL ORDER BY id LIMIT ?", lastID, batch); err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := fresh.Index(m); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < batch {
+			break
+		}
+		lastID = msgs[len(msgs)-1].ID
+	}
+
+	x.Lock()
+	x.postings, x.docs = fresh.postings, fresh.docs
+	x.Unlock()
+	return nil
+}
+
+// highlight cuts a snippet around the first match of terms out of content
+// and marks every match in it.
+func highlight(content string, terms []string) template.HTML {
+	orig := []rune(content)
+	lower := lowerRunes(content)
+	needles := make([][]rune, 0, len(terms))
+	for _, t := range terms {
+		needles = append(needles, lowerRunes(t))
+	}
+
+	// match[i] is the length of the match starting at i
+	match := make(map[int]int)
+	first := -1
+	for i := 0; i < len(lower); i++ {
+		for _, n := range needles {
+			if len(n) > 0 && i+len(n) <= len(lower) && string(lower[i:i+len(n)]) == string(n) {
+				match[i] = len(n)
+				if first < 0 {
+					first = i
+				}
+				i += len(n) - 1
+				break
+			}
+		}
+	}
+
+	start := first - snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := start + 2*snippetRadius + 20
+	if end > len(orig) {
+		end = len(orig)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if n, ok := match[i]; ok {
+			b.WriteString("<mark>")
+			b.WriteString(template.HTMLEscapeString(string(orig[i : i+n])))
+			b.WriteString("</mark>")
+			i += n
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(string(orig[i])))
+		i++
+	}
+	if end < len(orig) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+func parseSearchDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// getSearch searches the messages of the channels the user can read.
+// Filters are channel_id, user_name and the from/to dates (to inclusive).
+// The page is rendered as HTML unless JSON is asked for in Accept.
+func getSearch(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	q := &SearchQuery{Terms: strings.Fields(c.QueryParam("q")), BeforeID: int64(1<<63 - 1), Limit: searchResultsPerPage}
+	chanID, _ := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if chanID != 0 {
+		if ok, err := authorize(self.ID, chanID, ActionRead, 0); err != nil {
+			log.Println(err)
+			return err
+		} else if !ok {
+			return echo.ErrForbidden
+		}
+		q.ChannelIDs = []int64{chanID}
+	} else {
+		for _, ch := range channelCacher.GetAllFor(self.ID) {
+			q.ChannelIDs = append(q.ChannelIDs, ch.ID)
+		}
+	}
+	author := strings.TrimPrefix(c.QueryParam("user_name"), "@")
+	if author != "" {
+		err := db.Get(&q.AuthorID, "SELECT id FROM user WHERE name = ?", author)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", author))
+		} else if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	if q.Since, err = parseSearchDate(c.QueryParam("from")); err != nil {
+		return ErrBadReqeust
+	}
+	if q.Until, err = parseSearchDate(c.QueryParam("to")); err != nil {
+		return ErrBadReqeust
+	}
+	if !q.Until.IsZero() {
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+	if s := c.QueryParam("before_id"); s != "" {
+		if q.BeforeID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return ErrBadReqeust
+		}
+	}
+
+	results := make([]map[string]interface{}, 0)
+	var nextID int64
+	if len(q.Terms) > 0 && len(q.ChannelIDs) > 0 {
+		ids, err := searchIndex.Search(q)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		if len(ids) == searchResultsPerPage {
+			nextID = ids[len(ids)-1]
+		}
+		if results, err = searchResults(ids, q.Terms); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"results":   results,
+			"before_id": nextID,
+		})
+	}
+
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return c.Render(http.StatusOK, "search", map[string]interface{}{
+		"ChannelID":       int64(0),
+		"Channels":        channels,
+		"User":            self,
+		"Query":           c.QueryParam("q"),
+		"SearchChannelID": chanID,
+		"Author":          author,
+		"From":            c.QueryParam("from"),
+		"To":              c.QueryParam("to"),
+		"Results":         results,
+		"NextID":          nextID,
+	})
+}
+
+func searchResults(ids []int64, terms []string) ([]map[string]interface{}, error) {
+	results := make([]map[string]interface{}, 0, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+	query, args, err := sqlx.In("SELECT m.*, u.name AS `user.name`, u.avatar_icon AS `user.avatar_icon`, u.display_name AS `user.display_name`, u.is_bot AS `user.is_bot`"+
+		" FROM message m JOIN user u ON m.user_id = u.id WHERE m.id IN (?) AND m.deleted_at IS NULL ORDER BY m.id DESC", ids)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(ids))
+	if err := db.Select(&msgs, query, args...); err != nil {
+		return nil, err
+	}
+
+	for _, m := range msgs {
+		content := string(lowerRunes(m.Content))
+		found := true
+		for _, t := range terms {
+			found = found && strings.Contains(content, string(lowerRunes(t)))
+		}
+		if !found {
+			continue
+		}
+		r := messageJSON(m)
+		r["channel_id"] = m.ChannelID
+		r["snippet"] = highlight(m.Content, terms)
+		r["url"] = messageURL(m)
+		if ch, ok := channelCacher.Get(channelKey(m.ChannelID)); ok {
+			r["channel_name"] = ch.Name
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// messageURL is the history page showing m. Replies are shown below their
+// parent.
+func messageURL(m *Message) string {
+	anchor := m.ID
+	if m.ParentID != nil {
+		anchor = *m.ParentID
+	}
+	return fmt.Sprintf("/history/%d?before_id=%d#message-%d", m.ChannelID, anchor+1, anchor)
+}
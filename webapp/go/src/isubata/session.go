@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSessionSecret = "secretonymoris"
+	// revocations reach the other nodes by the peers, the TTL bounds how
+	// long a lost peer event can leave a revoked session working
+	sessionGenCacheTTL = 10 * time.Second
+)
+
+var (
+	// sessionStore keeps the sessions on the server side. It is nil when
+	// the whole session lives in the cookie.
+	sessionStore  SessionStore
+	sessionMaxAge = 360000
+
+	cookieSameSite = http.SameSiteLaxMode
+	cookieSecure   = false
+
+	// sessionGenCacher saves a query per request for the session generation
+	// of a user
+	sessionGenCacher = &Cacher[int64]{
+		Cache: make(map[string]struct {
+			Value   int64
+			Expired time.Time
+		}),
+	}
+)
+
+type ServerSession struct {
+	// sha256 of the token in the cookie, so the table holds no credentials
+	ID        string    `db:"id"`
+	UserID    int64     `db:"user_id"`
+	UserAgent string    `db:"user_agent"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+type SessionStore interface {
+	Create(s *ServerSession) error
+	// Get returns nil for unknown and expired sessions.
+	Get(id string) (*ServerSession, error)
+	Delete(id string) error
+	ListForUser(userID int64) ([]*ServerSession, error)
+	DeleteForUser(userID int64) error
+}
+
+// newCookieStore signs cookies with the keys in ISUBATA_SESSION_KEYS,
+// separated by commas. New cookies use the first key, the others are still
+// accepted so keys can be rotated without logging everybody out.
+func newCookieStore() sessions.Store {
+	secrets := strings.Split(os.Getenv("ISUBATA_SESSION_KEYS"), ",")
+	keyPairs := make([][]byte, 0, 2*len(secrets))
+	for _, s := range secrets {
+		if s = strings.TrimSpace(s); s != "" {
+			keyPairs = append(keyPairs, []byte(s), nil)
+		}
+	}
+	if len(keyPairs) == 0 {
+		keyPairs = append(keyPairs, []byte(defaultSessionSecret), nil)
+	}
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options.HttpOnly = true
+	store.Options.SameSite = cookieSameSite
+	store.Options.Secure = cookieSecure
+	return store
+}
+
+func sessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   sessionMaxAge,
+		SameSite: cookieSameSite,
+		Secure:   cookieSecure,
+	}
+}
+
+// initSessionStore configures the server-side store from
+// ISUBATA_SESSION_STORE: "cookie" (default) keeps everything in the cookie,
+// "mysql" and "memory" keep the sessions on the server. The memory store
+// only works with a single app node: every node would know only the
+// sessions created on it, and isubata.conf sends /profile to s1 and the
+// rest to s3. It is refused when ISUBATA_PEERS is set.
+// ISUBATA_COOKIE_SAMESITE ("lax" by default, "strict" or "none") and
+// ISUBATA_COOKIE_SECURE=1 set the attributes of the session cookie.
+func initSessionStore() error {
+	switch os.Getenv("ISUBATA_COOKIE_SAMESITE") {
+	case "", "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		cookieSameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("unknown cookie samesite mode %q", os.Getenv("ISUBATA_COOKIE_SAMESITE"))
+	}
+	cookieSecure = os.Getenv("ISUBATA_COOKIE_SECURE") == "1"
+	// browsers drop SameSite=None cookies without Secure
+	if cookieSameSite == http.SameSiteNoneMode && !cookieSecure {
+		return fmt.Errorf("samesite none cookies require ISUBATA_COOKIE_SECURE=1")
+	}
+
+	if s := os.Getenv("ISUBATA_SESSION_MAX_AGE"); s != "" {
+		maxAge, err := strconv.Atoi(s)
+		if err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid session max age %q", s)
+		}
+		sessionMaxAge = maxAge
+	}
+
+	switch os.Getenv("ISUBATA_SESSION_STORE") {
+	case "", "cookie":
+		sessionStore = nil
+	case "mysql":
+		sessionStore = &mysqlSessionStore{}
+	case "memory":
+		if os.Getenv("ISUBATA_PEERS") != "" {
+			return fmt.Errorf("the memory session store can't be shared with ISUBATA_PEERS, use mysql")
+		}
+		sessionStore = newMemorySessionStore()
+	default:
+		return fmt.Errorf("unknown session store %q", os.Getenv("ISUBATA_SESSION_STORE"))
+	}
+	return nil
+}
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// currentSessionID returns the id of the server-side session of the request.
+func currentSessionID(c echo.Context) string {
+	sess, _ := session.Get("session", c)
+	token, _ := sess.Values["token"].(string)
+	if token == "" {
+		return ""
+	}
+	return sessionID(token)
+}
+
+type mysqlSessionStore struct{}
+
+func (*mysqlSessionStore) Create(s *ServerSession) error {
+	_, err := db.Exec("INSERT INTO session (id, user_id, user_agent, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		s.ID, s.UserID, s.UserAgent, s.CreatedAt, s.ExpiresAt)
+	return err
+}
+
+func (*mysqlSessionStore) Get(id string) (*ServerSession, error) {
+	s := ServerSession{}
+	err := db.Get(&s, "SELECT * FROM session WHERE id = ? AND expires_at > NOW()", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (*mysqlSessionStore) Delete(id string) error {
+	_, err := db.Exec("DELETE FROM session WHERE id = ?", id)
+	return err
+}
+
+func (*mysqlSessionStore) ListForUser(userID int64) ([]*ServerSession, error) {
+	ss := make([]*ServerSession, 0)
+	err := db.Select(&ss, "SELECT * FROM session WHERE user_id = ? AND expires_at > NOW() ORDER BY created_at DESC", userID)
+	return ss, err
+}
+
+func (*mysqlSessionStore) DeleteForUser(userID int64) error {
+	_, err := db.Exec("DELETE FROM session WHERE user_id = ?", userID)
+	return err
+}
+
+type memorySessionStore struct {
+	sync.Mutex
+	sessions map[string]*ServerSession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	s := &memorySessionStore{sessions: make(map[string]*ServerSession)}
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.expire()
+		}
+	}()
+	return s
+}
+
+func (m *memorySessionStore) expire() {
+	now := time.Now()
+	m.Lock()
+	for id, s := range m.sessions {
+		if !s.ExpiresAt.After(now) {
+			delete(m.sessions, id)
+		}
+	}
+	m.Unlock()
+}
+
+func (m *memorySessionStore) Create(s *ServerSession) error {
+	m.Lock()
+	m.sessions[s.ID] = s
+	m.Unlock()
+	return nil
+}
+
+func (m *memorySessionStore) Get(id string) (*ServerSession, error) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.Lock()
+	delete(m.sessions, id)
+	m.Unlock()
+	return nil
+}
+
+func (m *memorySessionStore) ListForUser(userID int64) ([]*ServerSession, error) {
+	now := time.Now()
+	m.Lock()
+	defer m.Unlock()
+	ss := make([]*ServerSession, 0)
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.ExpiresAt.After(now) {
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+func (m *memorySessionStore) DeleteForUser(userID int64) error {
+	m.Lock()
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	m.Unlock()
+	return nil
+}
+
+func querySessionGen(userID int64) (int64, error) {
+	key := strconv.FormatInt(userID, 10)
+	if gen, ok := sessionGenCacher.Get(key); ok {
+		return gen, nil
+	}
+	var gen int64
+	if err := db.Get(&gen, "SELECT session_gen FROM user WHERE id = ?", userID); err != nil {
+		return 0, err
+	}
+	sessionGenCacher.Set(key, gen, sessionGenCacheTTL)
+	return gen, nil
+}
+
+// sessionsRevoked drops the cached generation of userID and closes the
+// user's open streams on every node, after the generation was bumped.
+func sessionsRevoked(userID int64) {
+	sessionGenCacher.Delete(strconv.FormatInt(userID, 10))
+	broadcaster.Publish(&StreamEvent{Type: streamEventSessionsRevoked, Members: []int64{userID}})
+	peers.Broadcast(&PeerEvent{Type: peerEventSessionsRevoked, Members: []int64{userID}})
+}
+
+// revokeUserSessions logs userID out everywhere. Bumping the generation
+// voids the sessions that only live in cookies.
+func revokeUserSessions(userID int64) error {
+	if _, err := db.Exec("UPDATE user SET session_gen = session_gen + 1 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	sessionsRevoked(userID)
+	if sessionStore != nil {
+		return sessionStore.DeleteForUser(userID)
+	}
+	return nil
+}
+
+// postLogoutAll revokes every session of the user, this one included.
+func postLogoutAll(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	if err := revokeUserSessions(self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	sessClear(c)
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// postRevokeSession revokes one of the user's other sessions.
+func postRevokeSession(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	if sessionStore == nil {
+		return echo.ErrNotFound
+	}
+
+	id := c.FormValue("session_id")
+	s, err := sessionStore.Get(id)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if s == nil || s.UserID != self.ID {
+		return echo.ErrNotFound
+	}
+	if err := sessionStore.Delete(id); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/profile/"+self.Name)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic/encoder"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamEventMessage       = "message"
+	streamEventMessageEdited = "message_edited"
+	streamEventReaction      = "reaction"
+	// the members were removed from the channel, open streams re-check access
+	streamEventMembersRemoved = "members_removed"
+	// the sessions of the members were revoked, their streams are closed
+	streamEventSessionsRevoked = "sessions_revoked"
+
+	subscriberBufferSize = 64
+	streamPingInterval   = 30 * time.Second
+)
+
+type StreamEvent struct {
+	Type      string
+	ChannelID int64
+	Message   *Message
+	Reaction  *ReactionEvent
+	Members   []int64
+}
+
+// Broadcaster fans out events to every subscriber in this process.
+// A subscriber that can't keep up is dropped; its channel is closed so the
+// client reconnects and catches up from its last event id.
+type Broadcaster struct {
+	mutex sync.RWMutex
+	subs  map[chan *StreamEvent]struct{}
+}
+
+func newBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[chan *StreamEvent]struct{})}
+}
+
+func (b *Broadcaster) Subscribe() chan *StreamEvent {
+	ch := make(chan *StreamEvent, subscriberBufferSize)
+	b.mutex.Lock()
+	b.subs[ch] = struct{}{}
+	b.mutex.Unlock()
+	return ch
+}
+
+func (b *Broadcaster) Unsubscribe(ch chan *StreamEvent) {
+	b.mutex.Lock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.mutex.Unlock()
+}
+
+func (b *Broadcaster) HasSubscribers() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.subs) > 0
+}
+
+func (b *Broadcaster) Publish(ev *StreamEvent) {
+	b.mutex.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	b.mutex.Unlock()
+}
+
+func (b *Broadcaster) PublishMessage(m *Message) {
+	if !b.HasSubscribers() {
+		return
+	}
+	if m.User == nil {
+		u, err := getUser(m.UserID)
+		if err != nil || u == nil {
+			log.Println(err)
+			return
+		}
+		m.User = u
+	}
+	b.Publish(&StreamEvent{Type: streamEventMessage, ChannelID: m.ChannelID, Message: m})
+}
+
+var broadcaster = newBroadcaster()
+
+// revokedFor reports whether ev revokes the sessions of userID.
+func revokedFor(ev *StreamEvent, userID int64) bool {
+	for _, id := range ev.Members {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSSE(res *echo.Response, event string, id int64, data interface{}) error {
+	buf, err := encoder.Encode(data, 0)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(res, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, buf); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+func getStream(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	// EventSource sends Last-Event-ID on reconnect, which wins over the query.
+	lastIDStr := c.Request().Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = c.QueryParam("last_message_id")
+	}
+	var lastID int64
+	if lastIDStr != "" {
+		lastID, err = strconv.ParseInt(lastIDStr, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+	}
+	if ok, err := authorize(userID, chanID, ActionRead, 0); err != nil {
+		log.Println(err)
+		return err
+	} else if !ok {
+		return c.NoContent(http.StatusForbidden)
+	}
+	self, err := getUser(userID)
+	if err != nil {
+		return err
+	} else if self == nil {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	// subscribe before catching up so nothing is lost in between
+	sub := broadcaster.Subscribe()
+	defer broadcaster.Unsubscribe(sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	messages, err := querymessagesWithUsers(chanID, lastID, 100, 0)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if err := writeSSE(res, "message", messages[i].ID, messageJSON(messages[i])); err != nil {
+			return nil
+		}
+	}
+	if len(messages) > 0 {
+		lastID = messages[0].ID
+		if err := markHaveRead(userID, chanID, lastID); err != nil {
+			log.Println(err)
+		}
+	}
+
+	unreads, err := queryUnreads(userID)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if err := writeSSE(res, "unread", 0, unreads); err != nil {
+		return nil
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-ping.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case ev, ok := <-sub:
+			if !ok {
+				return nil
+			}
+			if ev.Type == streamEventSessionsRevoked {
+				if revokedFor(ev, userID) {
+					return nil
+				}
+				continue
+			}
+			if ev.Type == streamEventMembersRemoved {
+				if ev.ChannelID == chanID {
+					if ok, _ := authorize(userID, chanID, ActionRead, 0); !ok {
+						return nil
+					}
+				}
+				continue
+			}
+			if ev.ChannelID != chanID {
+				if ok, _ := authorize(userID, ev.ChannelID, ActionRead, 0); !ok {
+					continue
+				}
+			}
+			if ev.Type == streamEventReaction {
+				if ev.ChannelID == chanID {
+					if err := writeSSE(res, "reaction", 0, reactionJSON(ev.Reaction, userID)); err != nil {
+						return nil
+					}
+				}
+				continue
+			}
+			if ev.Type == streamEventMessageEdited {
+				if ev.ChannelID == chanID && ev.Message.ID <= lastID {
+					if err := writeSSE(res, "edit", 0, messageJSON(ev.Message)); err != nil {
+						return nil
+					}
+				}
+				continue
+			}
+			if ev.Type != streamEventMessage {
+				continue
+			}
+			if ev.ChannelID != chanID {
+				delta := map[string]interface{}{"channel_id": ev.ChannelID, "delta": 0}
+				if ev.Message.ParentID == nil {
+					delta["delta"] = 1
+				}
+				if ev.Message.UserID != userID && mentions(ev.Message.Content, self.Name) {
+					delta["mentions"] = 1
+				}
+				if err := writeSSE(res, "unread_delta", 0, []map[string]interface{}{delta}); err != nil {
+					return nil
+				}
+				continue
+			}
+			if ev.Message.ParentID != nil {
+				if err := writeSSE(res, "reply", 0, messageJSON(ev.Message)); err != nil {
+					return nil
+				}
+				continue
+			}
+			if ev.Message.ID <= lastID {
+				continue
+			}
+			if err := writeSSE(res, "message", ev.Message.ID, messageJSON(ev.Message)); err != nil {
+				return nil
+			}
+			lastID = ev.Message.ID
+			if err := markHaveRead(userID, chanID, lastID); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+
+	apiTokenPrefix = "isb_"
+	// last_used_at is only written when it is older than this
+	apiTokenTouchInterval = time.Minute
+)
+
+// routes that accept API tokens, keyed by echo route path
+var apiTokenRoutes = map[string]bool{
+	"/message":             true,
+	"/fetch":               true,
+	"/history/:channel_id": true,
+}
+
+type APIToken struct {
+	ID         int64      `db:"id"`
+	UserID     int64      `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	Scopes     string     `db:"scopes"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is who a request acts for, either through a session or an API
+// token.
+type Principal struct {
+	UserID int64
+	// Token is set when the request authenticated with an API token.
+	Token *APIToken
+}
+
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(c echo.Context) string {
+	h := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// currentPrincipal resolves the principal of the request once and caches it
+// in the context. It is nil for anonymous requests.
+func currentPrincipal(c echo.Context) *Principal {
+	if p, ok := c.Get("principal").(*Principal); ok {
+		return p
+	}
+	var p *Principal
+	if token := bearerToken(c); token != "" {
+		p = tokenPrincipal(c, token)
+	} else if userID := sessionUserID(c); userID != 0 {
+		p = &Principal{UserID: userID}
+	}
+	c.Set("principal", p)
+	return p
+}
+
+// tokenPrincipal accepts token on the routes open to API tokens when it has
+// the scope the request method needs: read for GET, write for the rest.
+func tokenPrincipal(c echo.Context, token string) *Principal {
+	if !apiTokenRoutes[c.Path()] {
+		return nil
+	}
+	t := APIToken{}
+	err := db.Get(&t, "SELECT * FROM api_token WHERE token_hash = ?", apiTokenHash(token))
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	scope := scopeWrite
+	if m := c.Request().Method; m == http.MethodGet || m == http.MethodHead {
+		scope = scopeRead
+	}
+	if !t.HasScope(scope) {
+		return nil
+	}
+
+	now := time.Now()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > apiTokenTouchInterval {
+		if _, err := db.Exec("UPDATE api_token SET last_used_at = ? WHERE id = ?", now, t.ID); err != nil {
+			log.Println(err)
+		}
+	}
+	return &Principal{UserID: t.UserID, Token: &t}
+}
+
+func queryAPITokens(userID int64) ([]*APIToken, error) {
+	tokens := make([]*APIToken, 0)
+	err := db.Select(&tokens, "SELECT * FROM api_token WHERE user_id = ? ORDER BY id", userID)
+	return tokens, err
+}
+
+// postAPIToken creates a token and shows it once; only its hash is stored.
+func postAPIToken(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" || len(name) > 64 {
+		return ErrBadReqeust
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return ErrBadReqeust
+	}
+	scopes := make([]string, 0, 2)
+	for _, s := range form["scopes"] {
+		if s != scopeRead && s != scopeWrite {
+			return ErrBadReqeust
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		return ErrBadReqeust
+	}
+	sort.Strings(scopes)
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(b)
+	if _, err := db.Exec("INSERT INTO api_token (user_id, name, token_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		self.ID, name, apiTokenHash(token), strings.Join(scopes, ","), time.Now()); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return c.Render(http.StatusOK, "token_created", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Name":      name,
+		"Scopes":    strings.Join(scopes, ","),
+		"Token":     token,
+	})
+}
+
+func postRevokeAPIToken(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	tokenID, err := strconv.ParseInt(c.Param("token_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	res, err := db.Exec("DELETE FROM api_token WHERE id = ? AND user_id = ?", tokenID, self.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	return c.Redirect(http.StatusSeeOther, "/profile/"+self.Name)
+}
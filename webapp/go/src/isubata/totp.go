@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes of the neighbouring periods are accepted for clock drift
+	totpSkew = 1
+
+	totpMaxFailures   = 5
+	totpLockout       = 15 * time.Minute
+	totpPendingTTL    = 5 * time.Minute
+	recoveryCodeCount = 10
+	totpIssuer        = "isubata"
+)
+
+var errTOTPLocked = echo.NewHTTPError(http.StatusTooManyRequests, "too many invalid codes, try again later")
+
+type UserTOTP struct {
+	UserID         int64      `db:"user_id"`
+	Secret         string     `db:"secret"`
+	Enabled        bool       `db:"enabled"`
+	LastStep       int64      `db:"last_step"`
+	FailedAttempts int        `db:"failed_attempts"`
+	LockedUntil    *time.Time `db:"locked_until"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the RFC 6238 code of secret for the given time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// matchTOTP returns the step code matches, 0 if none does. Steps up to
+// lastStep were used already and are refused so a code works only once.
+func matchTOTP(secret string, code string, lastStep int64, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+func totpURI(secret, name string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+name) + "?" + q.Encode()
+}
+
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+func queryTOTP(userID int64) (*UserTOTP, error) {
+	t := UserTOTP{}
+	err := db.Get(&t, "SELECT * FROM user_totp WHERE user_id = ?", userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// checkSecondFactor verifies a TOTP code or, with allowRecovery, an unused
+// recovery code of the user of t. After totpMaxFailures wrong codes in a
+// row the user is locked out for totpLockout. t may be stale, concurrent
+// attempts are settled by the conditional updates.
+func checkSecondFactor(t *UserTOTP, code string, allowRecovery bool) (bool, error) {
+	now := time.Now()
+	if t.LockedUntil != nil && now.Before(*t.LockedUntil) {
+		return false, errTOTPLocked
+	}
+
+	code = strings.TrimSpace(code)
+	ok := false
+	if step := matchTOTP(t.Secret, code, t.LastStep, now); step != 0 {
+		// a code is only good once: when another request used this step
+		// already, nothing is updated and this one counts as a failure
+		res, err := db.Exec("UPDATE user_totp SET last_step = ?, failed_attempts = 0 WHERE user_id = ? AND last_step < ?"+
+			" AND (locked_until IS NULL OR locked_until <= ?)", step, t.UserID, step, now)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			ok = true
+		}
+	} else if allowRecovery && len(code) > totpDigits {
+		res, err := db.Exec("DELETE FROM recovery_code WHERE user_id = ? AND code_hash = ?", t.UserID, recoveryCodeHash(code))
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if _, err := db.Exec("UPDATE user_totp SET failed_attempts = 0 WHERE user_id = ?", t.UserID); err != nil {
+				return false, err
+			}
+			ok = true
+		}
+	}
+	if ok {
+		return true, nil
+	}
+
+	if _, err := db.Exec("UPDATE user_totp SET failed_attempts = failed_attempts + 1 WHERE user_id = ?", t.UserID); err != nil {
+		return false, err
+	}
+	if _, err := db.Exec("UPDATE user_totp SET failed_attempts = 0, locked_until = ? WHERE user_id = ? AND failed_attempts >= ?",
+		now.Add(totpLockout), t.UserID, totpMaxFailures); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// newRecoveryCodes replaces the recovery codes of userID and returns them.
+// Only their hashes are stored.
+func newRecoveryCodes(userID int64) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_code WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+		if _, err := tx.Exec("INSERT INTO recovery_code (user_id, code_hash, created_at) VALUES (?, ?, NOW())",
+			userID, recoveryCodeHash(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+func renderTOTP(c echo.Context, self *User, data map[string]interface{}) error {
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	data["ChannelID"] = 0
+	data["Channels"] = channels
+	data["User"] = self
+	return c.Render(http.StatusOK, "totp", data)
+}
+
+// postTOTPEnroll creates a new secret. It is only used once confirmed with
+// a code from the authenticator.
+func postTOTPEnroll(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	if t, err := queryTOTP(self.ID); err != nil {
+		log.Println(err)
+		return err
+	} else if t != nil && t.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "two-factor authentication is already enabled")
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		log.Println(err)
+		return err
+	}
+	secret := totpEncoding.EncodeToString(key)
+	if _, err := db.Exec("REPLACE INTO user_totp (user_id, secret, enabled, created_at) VALUES (?, ?, FALSE, NOW())",
+		self.ID, secret); err != nil {
+		log.Println(err)
+		return err
+	}
+	return renderTOTP(c, self, map[string]interface{}{
+		"Secret": secret,
+		"URI":    totpURI(secret, self.Name),
+	})
+}
+
+func postTOTPConfirm(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	t, err := queryTOTP(self.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if t == nil || t.Enabled {
+		return ErrBadReqeust
+	}
+
+	ok, err := checkSecondFactor(t, c.FormValue("code"), false)
+	if err != nil {
+		if err != errTOTPLocked {
+			log.Println(err)
+		}
+		return err
+	}
+	if !ok {
+		return renderTOTP(c, self, map[string]interface{}{
+			"Secret": t.Secret,
+			"URI":    totpURI(t.Secret, self.Name),
+			"Error":  "コードが正しくありません",
+		})
+	}
+	if _, err := db.Exec("UPDATE user_totp SET enabled = TRUE WHERE user_id = ?", self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	codes, err := newRecoveryCodes(self.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return renderTOTP(c, self, map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// postTOTPDisable turns two-factor authentication off. It takes a current
+// code so that a hijacked session alone can't do it.
+func postTOTPDisable(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	t, err := queryTOTP(self.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if t == nil || !t.Enabled {
+		return ErrBadReqeust
+	}
+	ok, err := checkSecondFactor(t, c.FormValue("code"), true)
+	if err != nil {
+		if err != errTOTPLocked {
+			log.Println(err)
+		}
+		return err
+	}
+	if !ok {
+		return echo.ErrForbidden
+	}
+	if err := resetTOTP(self.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/profile/"+self.Name)
+}
+
+func resetTOTP(userID int64) error {
+	if _, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM recovery_code WHERE user_id = ?", userID)
+	return err
+}
+
+// beginSecondFactor parks a user who passed the password check or single
+// sign-on until they enter a code. The session is only logged in after that.
+func beginSecondFactor(c echo.Context, userID int64) error {
+	sess, _ := session.Get("session", c)
+	sess.Values["mfa_user_id"] = userID
+	sess.Values["mfa_expires"] = time.Now().Add(totpPendingTTL).Unix()
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/login/2fa")
+}
+
+func pendingSecondFactor(c echo.Context) int64 {
+	sess, _ := session.Get("session", c)
+	userID, _ := sess.Values["mfa_user_id"].(int64)
+	expires, _ := sess.Values["mfa_expires"].(int64)
+	if userID == 0 || time.Now().Unix() > expires {
+		return 0
+	}
+	return userID
+}
+
+func getLoginTOTP(c echo.Context) error {
+	if pendingSecondFactor(c) == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Render(http.StatusOK, "login_2fa", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  []ChannelInfo{},
+		"User":      nil,
+	})
+}
+
+func postLoginTOTP(c echo.Context) error {
+	userID := pendingSecondFactor(c)
+	if userID == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	t, err := queryTOTP(userID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	// reset by an admin meanwhile: the password was enough after all
+	if t != nil && t.Enabled {
+		ok, err := checkSecondFactor(t, c.FormValue("code"), true)
+		if err != nil {
+			if err != errTOTPLocked {
+				log.Println(err)
+			} else {
+				audit(c, "totp_locked", map[string]interface{}{"user_id": userID})
+			}
+			return err
+		}
+		if !ok {
+			audit(c, "totp_failed", map[string]interface{}{"user_id": userID})
+			return echo.ErrForbidden
+		}
+	}
+
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "mfa_user_id")
+	delete(sess.Values, "mfa_expires")
+	if err := sessSetUserID(c, userID); err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// isAdmin reports whether u is listed in ISUBATA_ADMIN_USERS, separated by
+// commas.
+func isAdmin(u *User) bool {
+	for _, name := range strings.Split(os.Getenv("ISUBATA_ADMIN_USERS"), ",") {
+		if strings.TrimSpace(name) == u.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// postAdminResetTOTP turns two-factor authentication off for a user who
+// lost their authenticator and recovery codes.
+func postAdminResetTOTP(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	if !isAdmin(self) {
+		return echo.ErrForbidden
+	}
+
+	var target User
+	err = db.Get(&target, "SELECT id, name FROM user WHERE name = ?", c.Param("user_name"))
+	if err == sql.ErrNoRows {
+		return echo.ErrNotFound
+	} else if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := resetTOTP(target.ID); err != nil {
+		log.Println(err)
+		return err
+	}
+	audit(c, "totp_reset", map[string]interface{}{"admin": self.Name, "user_id": target.ID, "name": target.Name})
+	return c.Redirect(http.StatusSeeOther, "/profile/"+target.Name)
+}
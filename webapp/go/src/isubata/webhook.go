@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	webhookMaxBody    = 64 * 1024
+	webhookMaxText    = 4000
+	webhookRatePerMin = 60
+)
+
+type Webhook struct {
+	ID        int64     `db:"id"`
+	ChannelID int64     `db:"channel_id"`
+	UserID    int64     `db:"user_id"`
+	CreatorID int64     `db:"creator_id"`
+	Name      string    `db:"name"`
+	TokenHash string    `db:"token_hash"`
+	RateLimit int       `db:"rate_limit"`
+	CreatedAt time.Time `db:"created_at"`
+
+	User *User `db:"user"`
+}
+
+type WebhookPayload struct {
+	Text string `json:"text"`
+}
+
+// RateLimiter keeps a token bucket per key, refilled at perMinute per
+// minute. Allow takes a token for key; when there is none left it returns
+// how long to wait for the next one.
+type RateLimiter interface {
+	Allow(key int64, perMinute int) (bool, time.Duration, error)
+}
+
+type rateBucket struct {
+	Tokens float64   `db:"tokens"`
+	Last   time.Time `db:"last"`
+}
+
+func (b *rateBucket) take(now time.Time, perMinute int) (bool, time.Duration) {
+	rate := float64(perMinute) / 60
+	b.Tokens = math.Min(float64(perMinute), b.Tokens+now.Sub(b.Last).Seconds()*rate)
+	b.Last = now
+	if b.Tokens < 1 {
+		return false, time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+	}
+	b.Tokens--
+	return true, 0
+}
+
+// rateLimiter keeps the buckets in memory, so every node has its own and
+// the limit applies per node.
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[int64]*rateBucket
+	lastPrune time.Time
+}
+
+// mysqlRateLimiter keeps the buckets in the webhook_rate table, which the
+// nodes share.
+type mysqlRateLimiter struct{}
+
+var webhookLimiter RateLimiter = &rateLimiter{buckets: make(map[int64]*rateBucket)}
+
+// initWebhookLimiter configures where the webhook rate limits are kept:
+// ISUBATA_WEBHOOK_RATE_STORE is "memory" (default, per node) or "mysql".
+func initWebhookLimiter() error {
+	switch os.Getenv("ISUBATA_WEBHOOK_RATE_STORE") {
+	case "", "memory":
+		webhookLimiter = &rateLimiter{buckets: make(map[int64]*rateBucket)}
+	case "mysql":
+		webhookLimiter = &mysqlRateLimiter{}
+	default:
+		return fmt.Errorf("unknown webhook rate store %q", os.Getenv("ISUBATA_WEBHOOK_RATE_STORE"))
+	}
+	return nil
+}
+
+func (l *rateLimiter) Allow(key int64, perMinute int) (bool, time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	// a bucket refills completely within a minute, an idle one is the same
+	// as a new one
+	if now.Sub(l.lastPrune) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.Last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{Tokens: float64(perMinute), Last: now}
+		l.buckets[key] = b
+	}
+	allowed, wait := b.take(now, perMinute)
+	return allowed, wait, nil
+}
+
+func (*mysqlRateLimiter) Allow(key int64, perMinute int) (bool, time.Duration, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	// the row lock serializes the requests of both nodes
+	now := time.Now()
+	if _, err := tx.Exec("INSERT IGNORE INTO webhook_rate (webhook_id, tokens, last) VALUES (?, ?, ?)",
+		key, perMinute, now); err != nil {
+		return false, 0, err
+	}
+	b := rateBucket{}
+	if err := tx.Get(&b, "SELECT tokens, last FROM webhook_rate WHERE webhook_id = ? FOR UPDATE", key); err != nil {
+		return false, 0, err
+	}
+	allowed, wait := b.take(now, perMinute)
+	if _, err := tx.Exec("UPDATE webhook_rate SET tokens = ?, last = ? WHERE webhook_id = ?", b.Tokens, b.Last, key); err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, tx.Commit()
+}
+
+func webhookTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func webhookURL(c echo.Context, token string) string {
+	return fmt.Sprintf("%s://%s/hooks/%s", c.Scheme(), c.Request().Host, token)
+}
+
+func queryWebhooks(chanID int64) ([]*Webhook, error) {
+	hooks := make([]*Webhook, 0)
+	err := db.Select(&hooks, "SELECT w.*, u.name AS `user.name`, u.display_name AS `user.display_name`, u.avatar_icon AS `user.avatar_icon`"+
+		" FROM webhook w JOIN user u ON w.user_id = u.id WHERE w.channel_id = ? ORDER BY w.id", chanID)
+	return hooks, err
+}
+
+// postWebhookMessage posts {"text": "..."} to the channel of the webhook
+// named by the secret token in the URL.
+func postWebhookMessage(c echo.Context) error {
+	var hook Webhook
+	err := db.Get(&hook, "SELECT * FROM webhook WHERE token_hash = ?", webhookTokenHash(c.Param("token")))
+	if err == sql.ErrNoRows {
+		return echo.ErrNotFound
+	} else if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	ok, wait, err := webhookLimiter.Allow(hook.ID, hook.RateLimit)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "payload must be application/json")
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, webhookMaxBody+1))
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if len(body) > webhookMaxBody {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "payload too large")
+	}
+	var payload WebhookPayload
+	if err := decoder.NewDecoder(string(body)).Decode(&payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid JSON payload")
+	}
+	text := strings.TrimSpace(payload.Text)
+	if text == "" || !utf8.ValidString(text) || utf8.RuneCountInString(text) > webhookMaxText {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("text must be 1 to %d characters", webhookMaxText))
+	}
+
+	// webhook bots post without being channel members
+	id, err := storeMessage(hook.UserID, hook.ChannelID, 0, text)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"ok": true, "message_id": id})
+}
+
+// createBotUser adds the user that integrations post as. Bots have no
+// password and cannot log in.
+func createBotUser(tx *sqlx.Tx, displayName, avatar string) (int64, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, is_bot, created_at)"+
+		" VALUES (?, '', '', ?, ?, TRUE, NOW())", "bot-"+hex.EncodeToString(b), displayName, avatar)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func webhookChannel(c echo.Context) (*User, int64, error) {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return nil, 0, err
+	}
+	chanID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return nil, 0, ErrBadReqeust
+	}
+	if ok, err := authorize(self.ID, chanID, ActionManageWebhooks, 0); err != nil {
+		return nil, 0, err
+	} else if !ok {
+		return nil, 0, echo.ErrForbidden
+	}
+	return self, chanID, nil
+}
+
+// renderIntegrations shows the webhooks and slash commands of a channel.
+// newURL and newSecret are the credentials of one just created.
+func renderIntegrations(c echo.Context, self *User, chanID int64, newURL, newSecret string) error {
+	hooks, err := queryWebhooks(chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	cmds, err := queryCustomCommands(chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	ch, err := getChannelInfo(chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	channels := channelCacher.GetAllFor(self.ID)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return c.Render(http.StatusOK, "webhooks", map[string]interface{}{
+		"ChannelID":   chanID,
+		"Channels":    channels,
+		"User":        self,
+		"ChannelName": ch.Name,
+		"Webhooks":    hooks,
+		"NewURL":      newURL,
+		"RateLimit":   webhookRatePerMin,
+		"Commands":    cmds,
+		"NewSecret":   newSecret,
+	})
+}
+
+func getWebhooks(c echo.Context) error {
+	self, chanID, err := webhookChannel(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	return renderIntegrations(c, self, chanID, "", "")
+}
+
+// postWebhook creates a webhook posting as a new bot user. The URL holds the
+// secret and is only shown once.
+func postWebhook(c echo.Context) error {
+	self, chanID, err := webhookChannel(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	displayName := strings.TrimSpace(c.FormValue("display_name"))
+	if name == "" || len(name) > 64 {
+		return ErrBadReqeust
+	}
+	if displayName == "" {
+		displayName = name
+	}
+	rateLimit := webhookRatePerMin
+	if s := c.FormValue("rate_limit"); s != "" {
+		if rateLimit, err = strconv.Atoi(s); err != nil || rateLimit < 1 || rateLimit > 600 {
+			return ErrBadReqeust
+		}
+	}
+	avatar, err := saveAvatar(c, "avatar_icon")
+	if err != nil {
+		return err
+	}
+	if avatar == "" {
+		avatar = "default.png"
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer tx.Rollback()
+	botID, err := createBotUser(tx, displayName, avatar)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO webhook (channel_id, user_id, creator_id, name, token_hash, rate_limit, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, NOW())", chanID, botID, self.ID, name, webhookTokenHash(token), rateLimit); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return renderIntegrations(c, self, chanID, webhookURL(c, token), "")
+}
+
+func postDeleteWebhook(c echo.Context) error {
+	self, chanID, err := webhookChannel(c)
+	if self == nil {
+		log.Println(err)
+		return err
+	}
+	hookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	// the bot user stays, it still authors the messages already posted
+	res, err := db.Exec("DELETE FROM webhook WHERE id = ? AND channel_id = ?", hookID, chanID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks", chanID))
+}
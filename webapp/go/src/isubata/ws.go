@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/bytedance/sonic/decoder"
+	"github.com/bytedance/sonic/encoder"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket frame protocol shared by the browser client and bots.
+//
+// Every frame is a JSON object {"v": 1, "type": ..., "channel_id": ..., "payload": {...}}.
+//
+// client -> server:
+//
+//	subscribe   payload {"last_message_id"}  start receiving messages of channel_id
+//	unsubscribe                              stop receiving messages of channel_id
+//	send        payload {"content", "ref"}   post a message to channel_id,
+//	            optionally {"parent_id"} to reply in a thread; "/name args"
+//	            runs a command and "//text" posts "/text", as POST /message
+//	ack         payload {"message_id"}       mark channel_id as read up to message_id
+//	ping
+//
+// server -> client:
+//
+//	message     payload is the same object as GET /message returns
+//	reply       payload is a thread reply in a subscribed channel
+//	edited      payload is the edited or deleted message, sent for messages already delivered
+//	reaction    payload {"message_id", "emoji", "count", "me"}, "me" only when the
+//	            reaction was changed by this user
+//	sent        payload {"id", "ref"}, id is 0 for a command without a reply
+//	ephemeral   payload {"text", "ref"}, the reply to a command, shown to the
+//	            sender only
+//	error       payload {"code", "message", "ref"}
+//	pong
+const wsProtocolVersion = 1
+
+const (
+	wsFrameSubscribe   = "subscribe"
+	wsFrameUnsubscribe = "unsubscribe"
+	wsFrameSend        = "send"
+	wsFrameAck         = "ack"
+	wsFramePing        = "ping"
+
+	wsFrameMessage   = "message"
+	wsFrameReply     = "reply"
+	wsFrameEdited    = "edited"
+	wsFrameReaction  = "reaction"
+	wsFrameSent      = "sent"
+	wsFrameEphemeral = "ephemeral"
+	wsFrameError     = "error"
+	wsFramePong      = "pong"
+)
+
+type WSFrame struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	ChannelID int64       `json:"channel_id,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+type WSClientFrame struct {
+	Version   int    `json:"v"`
+	Type      string `json:"type"`
+	ChannelID int64  `json:"channel_id"`
+	Payload   struct {
+		Content       string `json:"content"`
+		ParentID      int64  `json:"parent_id"`
+		Ref           string `json:"ref"`
+		MessageID     int64  `json:"message_id"`
+		LastMessageID int64  `json:"last_message_id"`
+	} `json:"payload"`
+}
+
+type wsSession struct {
+	conn   *websocket.Conn
+	userID int64
+
+	writeMutex sync.Mutex
+
+	mutex  sync.Mutex
+	lastID map[int64]int64 // subscribed channel id -> last delivered message id
+}
+
+func (s *wsSession) write(frame *WSFrame) error {
+	frame.Version = wsProtocolVersion
+	buf, err := encoder.Encode(frame, 0)
+	if err != nil {
+		return err
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return websocket.Message.Send(s.conn, string(buf))
+}
+
+func (s *wsSession) writeError(chanID int64, code int, msg, ref string) error {
+	return s.write(&WSFrame{
+		Type:      wsFrameError,
+		ChannelID: chanID,
+		Payload:   map[string]interface{}{"code": code, "message": msg, "ref": ref},
+	})
+}
+
+// deliver sends m unless it has already been sent or the channel is not subscribed.
+func (s *wsSession) deliver(m *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deliverLocked(m)
+}
+
+// deliverLocked is deliver with s.mutex held. The frame is written under the
+// lock so that messages go out in the order lastID advances.
+func (s *wsSession) deliverLocked(m *Message) error {
+	lastID, ok := s.lastID[m.ChannelID]
+	if ok && m.ParentID != nil {
+		return s.write(&WSFrame{Type: wsFrameReply, ChannelID: m.ChannelID, Payload: messageJSON(m)})
+	}
+	if !ok || m.ID <= lastID {
+		return nil
+	}
+	s.lastID[m.ChannelID] = m.ID
+	return s.write(&WSFrame{Type: wsFrameMessage, ChannelID: m.ChannelID, Payload: messageJSON(m)})
+}
+
+// deliverEdit sends an edit of a message this session has already received.
+func (s *wsSession) deliverEdit(m *Message) error {
+	s.mutex.Lock()
+	lastID, ok := s.lastID[m.ChannelID]
+	s.mutex.Unlock()
+	if !ok || m.ID > lastID {
+		return nil
+	}
+	return s.write(&WSFrame{Type: wsFrameEdited, ChannelID: m.ChannelID, Payload: messageJSON(m)})
+}
+
+func (s *wsSession) deliverReaction(chanID int64, ev *ReactionEvent) error {
+	s.mutex.Lock()
+	_, ok := s.lastID[chanID]
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.write(&WSFrame{Type: wsFrameReaction, ChannelID: chanID, Payload: reactionJSON(ev, s.userID)})
+}
+
+// subscribe catches up from lastID under the session lock, so live messages
+// arriving meanwhile wait and can't skip lastID past the catch-up.
+func (s *wsSession) subscribe(chanID, lastID int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastID[chanID] = lastID
+
+	messages, err := querymessagesWithUsers(chanID, lastID, 100, 0)
+	if err != nil {
+		return err
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if err := s.deliverLocked(messages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recheck unsubscribes from chanID when the user may no longer read it.
+func (s *wsSession) recheck(chanID int64) error {
+	s.mutex.Lock()
+	_, ok := s.lastID[chanID]
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if ok, err := authorize(s.userID, chanID, ActionRead, 0); err != nil || ok {
+		return err
+	}
+	s.mutex.Lock()
+	delete(s.lastID, chanID)
+	s.mutex.Unlock()
+	return s.writeError(chanID, http.StatusForbidden, "forbidden", "")
+}
+
+func (s *wsSession) handle(frame *WSClientFrame) error {
+	if frame.Version != wsProtocolVersion {
+		return s.writeError(frame.ChannelID, http.StatusBadRequest,
+			fmt.Sprintf("unsupported protocol version %d", frame.Version), frame.Payload.Ref)
+	}
+	if frame.Type != wsFramePing && frame.ChannelID <= 0 {
+		return s.writeError(0, http.StatusBadRequest, "channel_id is required", frame.Payload.Ref)
+	}
+
+	switch frame.Type {
+	case wsFramePing:
+		return s.write(&WSFrame{Type: wsFramePong})
+	case wsFrameSubscribe:
+		if ok, err := authorize(s.userID, frame.ChannelID, ActionRead, 0); err != nil {
+			return err
+		} else if !ok {
+			return s.writeError(frame.ChannelID, http.StatusForbidden, "forbidden", frame.Payload.Ref)
+		}
+		return s.subscribe(frame.ChannelID, frame.Payload.LastMessageID)
+	case wsFrameUnsubscribe:
+		s.mutex.Lock()
+		delete(s.lastID, frame.ChannelID)
+		s.mutex.Unlock()
+		return nil
+	case wsFrameSend:
+		user, err := getUser(s.userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return s.writeError(frame.ChannelID, http.StatusForbidden, "user not found", frame.Payload.Ref)
+		}
+		id, reply, err := sendMessage(user, frame.ChannelID, frame.Payload.ParentID, frame.Payload.Content)
+		if herr, ok := err.(*echo.HTTPError); ok {
+			return s.writeError(frame.ChannelID, herr.Code, fmt.Sprint(herr.Message), frame.Payload.Ref)
+		} else if err != nil {
+			return err
+		}
+		if reply != "" {
+			return s.write(&WSFrame{
+				Type:      wsFrameEphemeral,
+				ChannelID: frame.ChannelID,
+				Payload:   map[string]interface{}{"text": reply, "ref": frame.Payload.Ref},
+			})
+		}
+		return s.write(&WSFrame{
+			Type:      wsFrameSent,
+			ChannelID: frame.ChannelID,
+			Payload:   map[string]interface{}{"id": id, "ref": frame.Payload.Ref},
+		})
+	case wsFrameAck:
+		if frame.Payload.MessageID <= 0 {
+			return s.writeError(frame.ChannelID, http.StatusBadRequest, "message_id is required", frame.Payload.Ref)
+		}
+		if ok, err := authorize(s.userID, frame.ChannelID, ActionRead, 0); err != nil {
+			return err
+		} else if !ok {
+			return s.writeError(frame.ChannelID, http.StatusForbidden, "forbidden", frame.Payload.Ref)
+		}
+		return markHaveRead(s.userID, frame.ChannelID, frame.Payload.MessageID)
+	default:
+		return s.writeError(frame.ChannelID, http.StatusBadRequest,
+			fmt.Sprintf("unknown frame type %q", frame.Type), frame.Payload.Ref)
+	}
+}
+
+// wsHandshake accepts clients without an Origin header (bots) but rejects
+// browsers connecting from another site.
+func wsHandshake(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != req.Host {
+		return fmt.Errorf("cross origin websocket request from %s", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+func getWebSocket(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	websocket.Server{
+		Handshake: wsHandshake,
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			s := &wsSession{conn: conn, userID: userID, lastID: make(map[int64]int64)}
+
+			sub := broadcaster.Subscribe()
+			defer broadcaster.Unsubscribe(sub)
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case ev, ok := <-sub:
+						if !ok {
+							conn.Close()
+							return
+						}
+						var err error
+						switch ev.Type {
+						case streamEventMessage:
+							err = s.deliver(ev.Message)
+						case streamEventMessageEdited:
+							err = s.deliverEdit(ev.Message)
+						case streamEventReaction:
+							err = s.deliverReaction(ev.ChannelID, ev.Reaction)
+						case streamEventMembersRemoved:
+							err = s.recheck(ev.ChannelID)
+						case streamEventSessionsRevoked:
+							if revokedFor(ev, s.userID) {
+								conn.Close()
+								return
+							}
+						}
+						if err != nil {
+							conn.Close()
+							return
+						}
+					}
+				}
+			}()
+
+			for {
+				var data string
+				if err := websocket.Message.Receive(conn, &data); err != nil {
+					return
+				}
+				frame := WSClientFrame{}
+				if err := decoder.NewDecoder(data).Decode(&frame); err != nil {
+					if err := s.writeError(0, http.StatusBadRequest, "malformed frame", ""); err != nil {
+						return
+					}
+					continue
+				}
+				if err := s.handle(&frame); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+		},
+	}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -1,18 +1,155 @@
 var last_message_id = 0
+var last_revision_id = null
+var current_thread_id = null
 
-function append(msg) {
-    var text = msg["content"]
+// every POST, PUT and DELETE must carry the token of the session
+$.ajaxSetup({
+    headers: {"X-CSRF-Token": $('meta[name="csrf-token"]').attr("content")}
+})
+
+function render_content(msg, elem) {
+    if (msg["deleted"]) {
+        elem.addClass("message-deleted").text("このメッセージは削除されました")
+        return
+    }
+    // the edit prompt needs the content as typed
+    elem.data("raw", msg["content"])
+    if (msg["content"].indexOf("/me ") == 0) {
+        elem.addClass("message-emote").text(msg["user"]["display_name"] + " " + msg["content"].substring(4))
+    } else {
+        elem.removeClass("message-emote").text(msg["content"])
+    }
+}
+
+function render_date(msg, elem) {
+    elem.text(msg["date"])
+    if (msg["deleted"]) {
+        return
+    }
+    if (msg["edited_at"]) {
+        $('<span class="message-edited"></span>').attr('title', msg["edited_at"]).text(" (編集済み)").appendTo(elem)
+    }
+    var own = msg["user"]["name"] == $("#timeline").data("user-name")
+    if (own) {
+        $('<a href="#" class="message-edit"></a>').text(" 編集").click(function(e) {
+            e.preventDefault()
+            on_edit_button(msg["id"])
+        }).appendTo(elem)
+    }
+    $('<a href="#" class="message-remind"></a>').text(" リマインド").click(function(e) {
+        e.preventDefault()
+        on_remind_button(msg["id"])
+    }).appendTo(elem)
+    if (own || $("#timeline").data("moderator")) {
+        $('<a href="#" class="message-delete"></a>').text(" 削除").click(function(e) {
+            e.preventDefault()
+            on_delete_button(msg["id"])
+        }).appendTo(elem)
+    }
+}
+
+function render_thread(msg, elem) {
+    elem.empty()
+    if (msg["parent_id"] != null || msg["deleted"]) {
+        return
+    }
+    var count = msg["reply_count"]
+    var link = $('<a href="#" class="thread-link"></a>').click(function(e) {
+        e.preventDefault()
+        open_thread(msg["id"])
+    }).appendTo(elem)
+    if (0 < count) {
+        link.text(count + "件の返信")
+        $('<span class="thread-last-reply"></span>').text(" 最終返信 " + msg["last_reply_at"]).appendTo(elem)
+    } else {
+        link.text("返信する")
+    }
+    if (0 < msg["thread_unread"]) {
+        $('<span class="badge badge-pill badge-primary"></span>').text(msg["thread_unread"]).appendTo(elem)
+    }
+}
+
+function render_reactions(msg, elem) {
+    elem.empty()
+    if (msg["deleted"]) {
+        return
+    }
+    (msg["reactions"] || []).forEach(function(r) {
+        if (r["count"] <= 0) return
+        $('<button type="button" class="btn btn-sm reaction"></button>')
+            .toggleClass("btn-primary", !!r["me"])
+            .toggleClass("btn-secondary", !r["me"])
+            .attr("data-emoji", r["emoji"])
+            .text(":" + r["emoji"] + ": " + r["count"])
+            .click(function() {
+                toggle_reaction(msg["id"], r["emoji"], !r["me"])
+            })
+            .appendTo(elem)
+    })
+    $('<a href="#" class="reaction-add"></a>').text(" リアクション").click(function(e) {
+        e.preventDefault()
+        var emoji = window.prompt("絵文字コード (例: +1, smile)")
+        if (emoji) {
+            toggle_reaction(msg["id"], emoji.replace(/:/g, ""), true)
+        }
+    }).appendTo(elem)
+    elem.data("reactions", msg["reactions"] || [])
+}
+
+// apply_reaction merges a single reaction change into the rendered message.
+function apply_reaction(ev) {
+    var p = $("#message-" + ev["message_id"])
+    if (p.length == 0) return
+    var elem = p.find("div.reactions")
+    var reactions = elem.data("reactions") || []
+    var found = false
+    reactions.forEach(function(r) {
+        if (r["emoji"] == ev["emoji"]) {
+            r["count"] = ev["count"]
+            if ("me" in ev) r["me"] = ev["me"]
+            found = true
+        }
+    })
+    if (!found) {
+        reactions.push({emoji: ev["emoji"], count: ev["count"], me: !!ev["me"]})
+    }
+    render_reactions({id: ev["message_id"], reactions: reactions}, elem)
+}
+
+function toggle_reaction(id, emoji, add) {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: add ? "POST" : "DELETE",
+        url: "/message/" + id + "/reactions?" + $.param({emoji: emoji}),
+        success: apply_reaction
+    })
+}
+
+function build_message(msg) {
     var name = msg["user"]["display_name"] + "@" + msg["user"]["name"]
-    var date = msg["date"]
     var icon = msg["user"]["avatar_icon"]
-    var p = $('<div class="media message"></div>')
+    var p = $('<div class="media message"></div>').attr('id', 'message-'+msg["id"])
 		var body = $('<div class="media-body">')
     $('<img class="avatar d-flex align-self-start mr-3" alt="no avatar">').attr('src', '/icons/'+icon).appendTo(p)
-    $('<h5 class="mt-0"></h5>').append($('<a></a>').attr('href', '/profile/'+msg["user"]["name"]).text(name)).appendTo(body)
-    $('<p class="content"></p>').text(text).appendTo(body)
-    $('<p class="message-date"></p>').text(date).appendTo(body)
+    var header = $('<h5 class="mt-0"></h5>').append($('<a></a>').attr('href', '/profile/'+msg["user"]["name"]).text(name)).appendTo(body)
+    if (msg["user"]["is_bot"]) {
+        $('<span class="badge badge-default bot-badge"></span>').text("BOT").appendTo(header)
+    }
+    render_content(msg, $('<p class="content"></p>').appendTo(body))
+    render_date(msg, $('<p class="message-date"></p>').appendTo(body))
+    render_reactions(msg, $('<div class="reactions"></div>').appendTo(body))
+    render_thread(msg, $('<p class="message-thread"></p>').appendTo(body))
     body.appendTo(p)
-    p.appendTo("#timeline")
+    return p
+}
+
+function append(msg) {
+    if (msg["id"] <= last_message_id) {
+        update(msg)
+        return
+    }
+    build_message(msg).appendTo("#timeline")
     last_message_id = Math.max(last_message_id, msg['id'])
     var messages = $("div[class*='media message']")
     if (100 < messages.length) {
@@ -20,6 +157,47 @@ function append(msg) {
     }
 }
 
+// update re-renders a message that is already on the timeline.
+function update(msg) {
+    var p = $("#message-" + msg["id"])
+    if (p.length == 0) return
+    render_content(msg, p.find("p.content"))
+    render_date(msg, p.find("p.message-date").empty())
+    render_thread(msg, p.find("p.message-thread"))
+    if (msg["deleted"]) {
+        render_reactions(msg, p.find("div.reactions"))
+    }
+}
+
+function open_thread(id) {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "GET",
+        url: "/message/" + id + "/thread",
+        success: function(thread) {
+            current_thread_id = id
+            var replies = $("#thread-replies").empty()
+            build_message(thread["parent"]).appendTo(replies)
+            thread["replies"].forEach(append_reply)
+            $("#thread").show()
+            $("#message-" + id).find("p.message-thread .badge").remove()
+        }
+    })
+}
+
+function close_thread() {
+    current_thread_id = null
+    $("#thread").hide()
+}
+
+function append_reply(msg) {
+    if (msg["parent_id"] != current_thread_id || $("#message-" + msg["id"]).length) {
+        return
+    }
+    build_message(msg).appendTo("#thread-replies")
+}
+
 function go_bottom() {
     $(window).scrollTop($(document).height());
 }
@@ -59,49 +237,283 @@ function get_message(callback) {
         return
     }
 
+    var data = {
+        last_message_id: last_message_id,
+        channel_id: channel_id
+    }
+    if (last_revision_id != null) {
+        data.last_revision_id = last_revision_id
+    }
+
     $.ajax({
         dataType: "json",
         async: true,
         type: "GET",
         url: "/message",
-        data: {
-            last_message_id: last_message_id,
-            channel_id: channel_id
-        },
-        success: function(messages) {
+        data: data,
+        success: function(messages, status, xhr) {
+            var rev = parseInt(xhr.getResponseHeader("X-Last-Revision-Id"))
+            if (!isNaN(rev)) {
+                last_revision_id = rev
+            }
             callback(messages)
         }
     })
 }
 
-function post_message(msg) {
+function post_message(msg, parent_id, callback) {
     channel_id = get_channel_id()
     if (channel_id == null) {
         console.error("channel_id is null")
         return
     }
 
+    var data = {
+        channel_id: channel_id,
+        message: msg
+    }
+    if (parent_id) {
+        data.parent_id = parent_id
+    }
+
     $.ajax({
         async: true,
         type: "POST",
         url: "/message",
+        data: data,
+        success: function(res) {
+            // slash commands answer the sender only
+            if (res && res["ephemeral"]) {
+                show_ephemeral(res["ephemeral"], parent_id)
+            }
+            if (callback) {
+                callback()
+            }
+        }
+    })
+}
+
+function show_ephemeral(text, parent_id) {
+    var p = $('<div class="ephemeral"></div>').text(text)
+    $('<small></small>').text(" (あなたにだけ表示されています)").appendTo(p)
+    p.appendTo(parent_id ? $("#thread-replies") : $("#timeline"))
+    if (!parent_id) {
+        go_bottom()
+    }
+}
+
+function edit_message(id, msg) {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "PUT",
+        url: "/message/" + id,
         data: {
-            channel_id: channel_id,
             message: msg
         },
+        success: update
     })
 }
 
+function delete_message(id) {
+    $.ajax({
+        async: true,
+        type: "DELETE",
+        url: "/message/" + id,
+        success: function() {
+            var p = $("#message-" + id)
+            render_content({deleted: true}, p.find("p.content"))
+            p.find("a.message-edit, a.message-delete, a.message-remind, span.message-edited").remove()
+        }
+    })
+}
+
+function on_delete_button(id) {
+    if (window.confirm("このメッセージを削除しますか？")) {
+        delete_message(id)
+    }
+}
+
+function on_edit_button(id) {
+    var current = $("#message-" + id).find("p.content").data("raw")
+    var msg = window.prompt("メッセージを編集", current)
+    if (msg == null || msg == "" || msg == current) {
+        return
+    }
+    edit_message(id, msg)
+}
+
 function on_send_button() {
     var textarea = $("#chatbox-textarea")
     var msg = textarea.val()
     if (msg == "") {
         return
     }
-    post_message(msg)
+    var send_at = $("#chatbox-send-at")
+    if (send_at.val()) {
+        schedule_message(msg, send_at.val())
+        send_at.val("")
+    } else {
+        post_message(msg)
+    }
     textarea.val("")
 }
 
+function schedule_message(msg, send_at) {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "POST",
+        url: "/message/schedule",
+        data: {
+            channel_id: get_channel_id(),
+            message: msg,
+            send_at: send_at
+        },
+        success: function(job) {
+            show_ephemeral(job["run_at"] + " に送信を予約しました")
+        }
+    })
+}
+
+function on_remind_button(id) {
+    var delay = window.prompt("何分後にリマインドしますか？ (例: 30m, 2h)", "1h")
+    if (delay == null || delay == "") {
+        return
+    }
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "POST",
+        url: "/message/" + id + "/remind",
+        data: {
+            in: delay
+        },
+        success: function(job) {
+            show_ephemeral(job["run_at"] + " にリマインドします")
+        }
+    })
+}
+
+function on_reply_button() {
+    var textarea = $("#thread-textarea")
+    var msg = textarea.val()
+    if (msg == "" || current_thread_id == null) {
+        return
+    }
+    var id = current_thread_id
+    post_message(msg, id, function() {
+        // the stream delivers replies by itself, polling clients reload the thread
+        if (!window.EventSource) {
+            open_thread(id)
+        }
+    })
+    textarea.val("")
+}
+
+function update_badges(json, channel_id) {
+    var updated = false
+    json.forEach(function(channel) {
+        var current_channel = channel.channel_id == channel_id
+        if (current_channel && 0 < channel.unread) {
+          updated = true
+        }
+        var badge = $("#unread-" + channel.channel_id)
+        var mentioned = !current_channel && 0 < channel.mentions
+        badge.toggleClass("badge-danger", mentioned).toggleClass("badge-primary", !mentioned)
+        if (mentioned) {
+          badge.text("@" + channel.mentions)
+        } else if (current_channel || channel.unread == 0) {
+          badge.text("")
+        } else {
+          badge.text(channel.unread.toString())
+        }
+    })
+    return updated
+}
+
+function start_polling() {
+    var loading = false
+    var ticks = 0
+
+    setInterval(function() {
+        if (loading) return
+        loading = true
+        ticks++
+        fetch_unread(function(json) {
+            console.log(json)
+            // poll /message now and then even without unread so edits show up
+            if (update_badges(json, get_channel_id()) || ticks % 100 == 0) {
+              get_message(function(new_messages) {
+                  if (0 < new_messages.length) {
+                      new_messages.forEach(append)
+                      go_bottom()
+                  }
+                  loading = false
+              })
+            } else {
+              loading = false
+            }
+        })
+    }, 10)
+}
+
+// start_stream subscribes to /stream and falls back to polling when the
+// server does not offer it.
+function start_stream() {
+    var channel_id = get_channel_id()
+    var unread = {}
+    var mentions = {}
+    var opened = false
+    var source = new EventSource("/stream?" + $.param({
+        channel_id: channel_id,
+        last_message_id: last_message_id
+    }))
+
+    source.onopen = function() {
+        opened = true
+    }
+    source.onerror = function() {
+        if (source.readyState == EventSource.CLOSED) {
+            source.close()
+            if (!opened) {
+                start_polling()
+            }
+        }
+    }
+    source.addEventListener("message", function(e) {
+        var msg = JSON.parse(e.data)
+        if (msg["id"] <= last_message_id) return
+        append(msg)
+        go_bottom()
+    })
+    source.addEventListener("reply", function(e) {
+        append_reply(JSON.parse(e.data))
+    })
+    source.addEventListener("reaction", function(e) {
+        apply_reaction(JSON.parse(e.data))
+    })
+    source.addEventListener("edit", function(e) {
+        update(JSON.parse(e.data))
+    })
+    source.addEventListener("unread", function(e) {
+        var json = JSON.parse(e.data)
+        json.forEach(function(channel) {
+            unread[channel.channel_id] = channel.unread
+            mentions[channel.channel_id] = channel.mentions
+        })
+        update_badges(json, channel_id)
+    })
+    source.addEventListener("unread_delta", function(e) {
+        var json = JSON.parse(e.data).map(function(channel) {
+            unread[channel.channel_id] = (unread[channel.channel_id] || 0) + channel.delta
+            mentions[channel.channel_id] = (mentions[channel.channel_id] || 0) + (channel.mentions || 0)
+            return {channel_id: channel.channel_id, unread: unread[channel.channel_id], mentions: mentions[channel.channel_id]}
+        })
+        update_badges(json, channel_id)
+    })
+}
+
 $(document).ready(function() {
 
     $("#chatbox-textarea").keydown(function(e) {
@@ -117,39 +529,10 @@ $(document).ready(function() {
     get_message(function(messages) {
         messages.forEach(append)
 
-        var loading = false
-
-        setInterval(function() {
-            if (loading) return
-            loading = true
-            fetch_unread(function(json) {
-                console.log(json)
-                channel_id = get_channel_id()
-                updated = false
-                json.forEach(function(channel) {
-                    current_channel = channel.channel_id == channel_id
-                    if (current_channel && 0 < channel.unread) {
-                      updated = true
-                    }
-                    var badge = $("#unread-" + channel.channel_id)
-                    if (current_channel || channel.unread == 0) {
-                      badge.text("")
-                    } else {
-                      badge.text(channel.unread.toString())
-                    }
-                })
-                if (updated) {
-                  get_message(function(new_messages) {
-                      if (0 < new_messages.length) {
-                          new_messages.forEach(append)
-                          go_bottom()
-                      }
-                      loading = false
-                  })
-                } else {
-                  loading = false
-                }
-            })
-        }, 10)
+        if (window.EventSource) {
+            start_stream()
+        } else {
+            start_polling()
+        }
     })
 })